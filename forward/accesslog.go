@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/context"
+)
+
+// LogLevel is a golog level to write log entries at
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelTrace
+	LogLevelError
+)
+
+// logRoundTrip writes the access log entry for a successful round trip,
+// sampled according to LogSampleRate.
+func (f *forwarder) logRoundTrip(req *http.Request, resp *http.Response, start time.Time) {
+	if f.AccessLogLevel == LogLevelTrace && !log.IsTraceEnabled() {
+		// Don't even count it
+		return
+	}
+	n := atomic.AddUint64(&f.successes, 1)
+	if f.LogSampleRate > 1 && (n-1)%uint64(f.LogSampleRate) != 0 {
+		return
+	}
+	entry := &accessLogEntry{req.URL.String(), resp.StatusCode, time.Now().UTC().Sub(start)}
+	if f.accessLog == nil || f.ctx.Err() != nil {
+		// Synchronous, or the writer is gone
+		f.writeAccessLog(entry)
+		return
+	}
+	select {
+	case f.accessLog <- entry:
+	default:
+		dropped := atomic.AddUint64(&f.droppedLogs, 1)
+		if f.OnAccessLogDrop != nil {
+			f.OnAccessLogDrop(dropped)
+		}
+	}
+}
+
+// writeAccessLogs writes the entries queued by AsyncAccessLog until the
+// forwarder is closed, flushing the queue then
+func (f *forwarder) writeAccessLogs() {
+	for {
+		select {
+		case entry := <-f.accessLog:
+			f.writeAccessLog(entry)
+		case <-f.ctx.Done():
+			for {
+				select {
+				case entry := <-f.accessLog:
+					f.writeAccessLog(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (f *forwarder) writeAccessLog(entry *accessLogEntry) {
+	switch f.AccessLogLevel {
+	case LogLevelTrace:
+		log.Trace(entry)
+	case LogLevelError:
+		log.Error(entry)
+	default:
+		log.Debug(entry)
+	}
+}
+
+// accessLogEntry is an access log line, which also exposes its fields to
+// structured log outputs
+type accessLogEntry struct {
+	url      string
+	status   int
+	duration time.Duration
+}
+
+func (e *accessLogEntry) String() string {
+	return fmt.Sprintf("Round trip: %v, code: %v, duration: %v", e.url, e.status, e.duration)
+}
+
+// Error makes entries logged as errors keep their fields
+func (e *accessLogEntry) Error() string {
+	return e.String()
+}
+
+// Fill implements context.Contextual, which golog takes the values of log
+// entries from
+func (e *accessLogEntry) Fill(m context.Map) {
+	m["url"] = e.url
+	m["status"] = e.status
+	m["duration_ms"] = float64(e.duration) / float64(time.Millisecond)
+}
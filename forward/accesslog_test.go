@@ -0,0 +1,220 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+	"github.com/getlantern/http-proxy/utils"
+)
+
+func TestLogSampleRate(t *testing.T) {
+	var errorOut, debugOut bytes.Buffer
+	golog.SetOutputs(&errorOut, &debugOut)
+	defer golog.ResetOutputs()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:   30 * time.Second,
+		LogSampleRate: 10,
+	}))
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		fwd.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", closed.URL, nil)
+		fwd.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, 10, countLines(debugOut.String(), "Round trip:"), "should log 1 in 10 successes")
+	assert.Equal(t, 5, countLines(errorOut.String(), "Responding with 502"), "should log all errors")
+}
+
+func TestAccessLogLevel(t *testing.T) {
+	if log.IsTraceEnabled() {
+		t.Skip("tracing is enabled")
+	}
+	var errorOut, debugOut bytes.Buffer
+	golog.SetOutputs(&errorOut, &debugOut)
+	defer golog.ResetOutputs()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	for level, expected := range map[LogLevel]int{LogLevelDebug: 1, LogLevelTrace: 0} {
+		debugOut.Reset()
+		fwd := filters.Join(New(&Options{
+			IdleTimeout:    30 * time.Second,
+			AccessLogLevel: level,
+		}))
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		fwd.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, expected, countLines(debugOut.String(), "Round trip:"), "level %v", level)
+	}
+
+	errorOut.Reset()
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:    30 * time.Second,
+		AccessLogLevel: LogLevelError,
+	}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, 1, countLines(errorOut.String(), "Round trip:"))
+}
+
+func countLines(out string, substr string) int {
+	n := 0
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAccessLogSlog(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	reset := golog.SetOutput(utils.SlogLogger(logger))
+	defer reset()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{IdleTimeout: 30 * time.Second}))
+	req, _ := http.NewRequest("GET", origin.URL+"/path", nil)
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]interface{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		var record map[string]interface{}
+		if json.Unmarshal([]byte(line), &record) == nil && strings.HasPrefix(record["msg"].(string), "Round trip") {
+			entry = record
+		}
+	}
+	if assert.NotNil(t, entry, "access log entry missing from %v", out.String()) {
+		assert.Equal(t, "DEBUG", entry["level"])
+		assert.Equal(t, "forward", entry["logger"])
+		assert.Equal(t, origin.URL+"/path", entry["url"])
+		assert.EqualValues(t, http.StatusOK, entry["status"])
+		assert.Contains(t, entry, "duration_ms")
+		assert.Equal(t, "proxy_http", entry["op"])
+	}
+}
+
+// blockingOutput is a golog output that holds access log entries until
+// released
+type blockingOutput struct {
+	entries chan string
+}
+
+func (o *blockingOutput) Debug(prefix string, skipFrames int, printStack bool, severity string, arg interface{}, values map[string]interface{}) {
+	if entry, ok := arg.(*accessLogEntry); ok {
+		o.entries <- entry.String()
+	}
+}
+
+func (o *blockingOutput) Error(prefix string, skipFrames int, printStack bool, severity string, arg interface{}, values map[string]interface{}) {
+}
+
+func TestAsyncAccessLog(t *testing.T) {
+	out := &blockingOutput{make(chan string)}
+	reset := golog.SetOutput(out)
+	defer reset()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	var dropped uint64
+	forwarder := New(&Options{
+		IdleTimeout:    30 * time.Second,
+		AsyncAccessLog: 2,
+		OnAccessLogDrop: func(n uint64) {
+			atomic.StoreUint64(&dropped, n)
+		},
+	})
+	fwd := filters.Join(forwarder)
+	// The first entry is being written and the next 2 are queued, the output
+	// being stuck doesn't hold up requests
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%v/%d", origin.URL, i), nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		if i == 0 {
+			// Wait for the writer to pick it up
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	assert.EqualValues(t, 0, atomic.LoadUint64(&dropped))
+
+	// No room left
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", origin.URL+"/dropped", nil)
+		fwd.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.EqualValues(t, 2, atomic.LoadUint64(&dropped))
+
+	for i := 0; i < 3; i++ {
+		select {
+		case entry := <-out.entries:
+			assert.Contains(t, entry, fmt.Sprintf("%v/%d", origin.URL, i))
+		case <-time.After(5 * time.Second):
+			t.Fatal("access log entry not delivered")
+		}
+	}
+	forwarder.(io.Closer).Close()
+}
+
+func TestAsyncAccessLogFlushedOnClose(t *testing.T) {
+	var errorOut, debugOut syncBuffer
+	reset := golog.SetOutputs(&errorOut, &debugOut)
+	defer reset()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	forwarder := New(&Options{
+		IdleTimeout:    30 * time.Second,
+		AsyncAccessLog: 100,
+	})
+	fwd := filters.Join(forwarder)
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest("GET", origin.URL+"/flushed", nil)
+		fwd.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	forwarder.(io.Closer).Close()
+	assert.Equal(t, 20, countLines(debugOut.String(), "/flushed"), "queued entries should have been written")
+
+	// Afterwards they're written right away
+	req, _ := http.NewRequest("GET", origin.URL+"/closed", nil)
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, 1, countLines(debugOut.String(), "/closed"))
+}
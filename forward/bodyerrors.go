@@ -0,0 +1,66 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+)
+
+// XBodyError is the trailer that tells the client why the response body was
+// cut short, with BodyErrorTrailer
+const XBodyError = "X-Body-Error"
+
+// BodyErrorMode is what the forwarder does when reading the response body
+// from the upstream fails, typically because it closed the connection
+type BodyErrorMode int
+
+const (
+	// BodyErrorTruncate ends the response to the client where the upstream's
+	// ended, which the client can only notice if it knew the length.
+	BodyErrorTruncate BodyErrorMode = iota
+	// BodyErrorTrailer always sends response bodies chunked, and adds an
+	// X-Body-Error trailer with the error to the ones that were truncated.
+	BodyErrorTrailer
+	// BodyErrorBadGateway responds with a 502 if reading fails before getting
+	// any of the body, and truncates otherwise.
+	BodyErrorBadGateway
+)
+
+// upstreamBody records the errors reading the upstream's response body, to
+// tell them apart from errors writing to the client
+type upstreamBody struct {
+	io.Reader
+	err error
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// peekBody reads the first bytes of body, failing if that fails already. The
+// returned body still yields all the bytes, and any error after them.
+func peekBody(body io.ReadCloser) (io.ReadCloser, error) {
+	buf := make([]byte, 512)
+	n, err := body.Read(buf)
+	switch {
+	case err == nil:
+		return &prefixedBody{io.MultiReader(bytes.NewReader(buf[:n]), body), body}, nil
+	case err == io.EOF:
+		return &prefixedBody{bytes.NewReader(buf[:n]), body}, nil
+	case n == 0:
+		return nil, err
+	default:
+		return &prefixedBody{io.MultiReader(bytes.NewReader(buf[:n]), errorReader{err}), body}, nil
+	}
+}
@@ -0,0 +1,86 @@
+package forward
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cuttingOrigin starts an origin that announces a 100 byte body but closes the
+// connection after sending the given part of it
+func cuttingOrigin(t *testing.T, part string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n" + part))
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String(), func() { l.Close() }
+}
+
+func TestBodyErrorModes(t *testing.T) {
+	originURL, closeOrigin := cuttingOrigin(t, "partial")
+	defer closeOrigin()
+
+	for _, mode := range []BodyErrorMode{BodyErrorTruncate, BodyErrorTrailer, BodyErrorBadGateway} {
+		var written int64 = -1
+		client, closeProxy := proxiedClient(New(&Options{
+			IdleTimeout:   30 * time.Second,
+			BodyErrorMode: mode,
+			OnBodyCopyError: func(n int64, err error) {
+				written = n
+			},
+		}))
+
+		resp, err := client.Get(originURL)
+		if !assert.NoError(t, err) {
+			closeProxy()
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "mode %v", mode)
+		assert.Equal(t, "partial", string(body), "mode %v", mode)
+		assert.EqualValues(t, 7, written, "mode %v", mode)
+		if mode == BodyErrorTrailer {
+			assert.Equal(t, "unexpected EOF", resp.Trailer.Get(XBodyError))
+		} else {
+			assert.Empty(t, resp.Trailer.Get(XBodyError))
+		}
+		closeProxy()
+	}
+}
+
+func TestBodyErrorBadGateway(t *testing.T) {
+	originURL, closeOrigin := cuttingOrigin(t, "")
+	defer closeOrigin()
+
+	client, closeProxy := proxiedClient(New(&Options{
+		IdleTimeout:   30 * time.Second,
+		BodyErrorMode: BodyErrorBadGateway,
+	}))
+	defer closeProxy()
+
+	resp, err := client.Get(originURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
@@ -0,0 +1,22 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+)
+
+// bufferSmallBody reads up to max bytes of body. If that's all there is, it
+// returns the length of the body, otherwise -1. Either way, the returned body
+// still yields all the bytes.
+func bufferSmallBody(body io.ReadCloser, max int) (io.ReadCloser, int64, error) {
+	buf := make([]byte, max+1)
+	n, err := io.ReadFull(body, buf)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return &prefixedBody{bytes.NewReader(buf[:n]), body}, int64(n), nil
+	case nil:
+		return &prefixedBody{io.MultiReader(bytes.NewReader(buf), body), body}, -1, nil
+	default:
+		return nil, 0, err
+	}
+}
@@ -0,0 +1,44 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestBufferSmallResponses(t *testing.T) {
+	large := strings.Repeat("a", 1000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Flushing before writing the body forces a chunked response
+		w.(http.Flusher).Flush()
+		if req.URL.Path == "/large" {
+			w.Write([]byte(large))
+		} else {
+			w.Write([]byte("small"))
+		}
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:          30 * time.Second,
+		BufferSmallResponses: 100,
+	}))
+
+	req, _ := http.NewRequest("GET", origin.URL+"/small", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, "small", w.Body.String())
+	assert.Equal(t, "5", w.Header().Get("Content-Length"))
+
+	req, _ = http.NewRequest("GET", origin.URL+"/large", nil)
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, large, w.Body.String())
+	assert.Empty(t, w.Header().Get("Content-Length"), "large responses should be streamed")
+}
@@ -0,0 +1,35 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+)
+
+// upstreamHostKey is the context key of the host name of the upstream a
+// request goes to, which is also the context of the TLS handshakes with it
+type upstreamHostKey struct{}
+
+// withUpstreamHost makes the upstream of the request known to
+// getClientCertificate
+func (f *forwarder) withUpstreamHost(req *http.Request) *http.Request {
+	if f.ClientCertSelector == nil {
+		return req
+	}
+	ctx := context.WithValue(req.Context(), upstreamHostKey{}, req.URL.Hostname())
+	return req.WithContext(ctx)
+}
+
+// getClientCertificate picks the client certificate with ClientCertSelector
+func (f *forwarder) getClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	host, _ := info.Context().Value(upstreamHostKey{}).(string)
+	cert, err := f.ClientCertSelector(host)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		// Tell the upstream we don't have any
+		return &tls.Certificate{}, nil
+	}
+	return cert, nil
+}
@@ -0,0 +1,113 @@
+package forward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+// selfSignedCert generates a certificate for the given name, valid both for
+// servers and clients
+func selfSignedCert(t *testing.T, name string) (*tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestClientCertSelector(t *testing.T) {
+	roots := x509.NewCertPool()
+	// Starts an origin for name that responds with the name on the client
+	// certificate it got
+	mtlsOrigin := func(name string) (*httptest.Server, *url.URL) {
+		origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if len(req.TLS.PeerCertificates) == 0 {
+				w.Write([]byte("none"))
+				return
+			}
+			w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+		}))
+		cert, x509Cert := selfSignedCert(t, name)
+		roots.AddCert(x509Cert)
+		origin.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}, ClientAuth: tls.RequestClientCert}
+		origin.StartTLS()
+		return origin, &url.URL{Scheme: "https", Host: name}
+	}
+	a, aURL := mtlsOrigin("a.internal")
+	defer a.Close()
+	b, bURL := mtlsOrigin("b.internal")
+	defer b.Close()
+	addrs := map[string]string{
+		"a.internal:443": a.Listener.Addr().String(),
+		"b.internal:443": b.Listener.Addr().String(),
+	}
+
+	clientCertA, _ := selfSignedCert(t, "client of a")
+	clientCertB, _ := selfSignedCert(t, "client of b")
+	var selected []string
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:     30 * time.Second,
+		UpstreamRootCAs: roots,
+		ClientCertSelector: func(host string) (*tls.Certificate, error) {
+			selected = append(selected, host)
+			switch host {
+			case "a.internal":
+				return clientCertA, nil
+			case "b.internal":
+				return clientCertB, nil
+			}
+			return nil, nil
+		},
+		Dialer: func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, addrs[addr])
+		},
+		Router: func(req *http.Request) *Route {
+			switch req.URL.Path {
+			case "/a":
+				return &Route{URL: aURL}
+			case "/b":
+				return &Route{URL: bURL}
+			}
+			return nil
+		},
+	}))
+
+	for path, expected := range map[string]string{"/a": "client of a", "/b": "client of b"} {
+		req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, expected, string(body))
+	}
+	assert.ElementsMatch(t, []string{"a.internal", "b.internal"}, selected)
+}
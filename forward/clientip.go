@@ -0,0 +1,62 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPStrategy determines the IP of the client that originally sent a
+// request, which may have gone through other proxies before reaching us.
+type ClientIPStrategy func(req *http.Request) string
+
+// DirectRemoteAddr takes the client IP from the address of the connection the
+// request came in on, ignoring any forwarding headers.
+func DirectRemoteAddr(req *http.Request) string {
+	return remoteIP(req)
+}
+
+// LeftmostXFF takes the client IP from the leftmost X-Forwarded-For entry,
+// falling back to the remote address. Since clients can send whatever
+// X-Forwarded-For they like, it's only safe when all requests go through
+// proxies that overwrite it.
+func LeftmostXFF(req *http.Request) string {
+	chain := forwardedChain(req)
+	return chain[0]
+}
+
+// RightmostTrusted takes the client IP from the X-Forwarded-For chain,
+// skipping the given number of trusted proxies in front of us from the right
+// (the remote address being the closest one).
+func RightmostTrusted(trustedHops int) ClientIPStrategy {
+	return func(req *http.Request) string {
+		chain := forwardedChain(req)
+		i := len(chain) - 1 - trustedHops
+		if i < 0 {
+			i = 0
+		}
+		return chain[i]
+	}
+}
+
+// forwardedChain returns the X-Forwarded-For entries followed by the remote
+// address, from the farthest to the closest hop.
+func forwardedChain(req *http.Request) []string {
+	var chain []string
+	for _, xff := range req.Header[XForwardedFor] {
+		for _, ip := range strings.Split(xff, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	return append(chain, remoteIP(req))
+}
+
+func remoteIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,51 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestClientIPStrategies(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://site.com/", nil)
+	// client -> 10.0.0.1 -> 10.0.0.2 -> us
+	req.Header.Add(XForwardedFor, "1.1.1.1, 10.0.0.1")
+	req.Header.Add(XForwardedFor, "10.0.0.2")
+	req.RemoteAddr = "10.0.0.3:5678"
+
+	assert.Equal(t, "10.0.0.3", DirectRemoteAddr(req))
+	assert.Equal(t, "1.1.1.1", LeftmostXFF(req))
+	assert.Equal(t, "10.0.0.3", RightmostTrusted(0)(req))
+	assert.Equal(t, "10.0.0.1", RightmostTrusted(2)(req))
+	assert.Equal(t, "1.1.1.1", RightmostTrusted(3)(req))
+	assert.Equal(t, "1.1.1.1", RightmostTrusted(10)(req), "shouldn't go past the farthest hop")
+
+	req.Header.Del(XForwardedFor)
+	assert.Equal(t, "10.0.0.3", LeftmostXFF(req), "should fall back to the remote address")
+}
+
+func TestClientIPStrategyRealIP(t *testing.T) {
+	received := make(chan http.Header, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:      30 * time.Second,
+		ClientIPStrategy: RightmostTrusted(1),
+	}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set(XForwardedFor, "6.6.6.6, 1.1.1.1")
+	req.RemoteAddr = "10.0.0.1:5678"
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+
+	header := <-received
+	assert.Equal(t, "1.1.1.1", header.Get(XRealIP))
+	assert.Equal(t, "6.6.6.6, 1.1.1.1, 10.0.0.1", header.Get(XForwardedFor))
+}
@@ -0,0 +1,155 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// collapser makes concurrent round trips with the same key share the one
+// that got there first.
+type collapser struct {
+	mx    sync.Mutex
+	calls map[string]*collapsedCall
+}
+
+type collapsedCall struct {
+	// done is closed once the round trip is over
+	done chan struct{}
+	// header is the one of the request that made the round trip
+	header http.Header
+	resp   *http.Response
+	body   []byte
+	err    error
+	// tooLarge is set when the body didn't fit in maxCollapsedBodyBytes
+	tooLarge bool
+}
+
+// maxCollapsedBodyBytes is the size of the largest response bodies buffered
+// to be shared between collapsed requests
+const maxCollapsedBodyBytes = 1 << 20
+
+func newCollapser() *collapser {
+	return &collapser{calls: make(map[string]*collapsedCall)}
+}
+
+func (f *forwarder) collapseKey(req *http.Request) (string, bool) {
+	if f.CoalesceKey != nil {
+		return f.CoalesceKey(req)
+	}
+	if !f.CollapseRequests {
+		return "", false
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return "", false
+	}
+	if isUpgrade(req.Header) {
+		// What follows the response isn't a body that can be shared
+		return "", false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" {
+		return "", false
+	}
+	// The URL is the upstream's, the Host tells apart the virtual hosts it
+	// serves
+	return strings.Join([]string{req.Method, req.URL.String(), req.Host, req.Header.Get("Accept-Encoding")}, " "), true
+}
+
+// roundTrip performs the round trip for the given key, unless one is already
+// in flight, in which case it waits for it. Response bodies of up to
+// maxCollapsedBodyBytes are buffered so that every caller gets its own copy of
+// the response. Larger ones are streamed to the first caller only, and the
+// others make their own round trip.
+func (c *collapser) roundTrip(key string, req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	c.mx.Lock()
+	call, inFlight := c.calls[key]
+	if !inFlight {
+		call = &collapsedCall{done: make(chan struct{}), header: req.Header}
+		c.calls[key] = call
+	}
+	c.mx.Unlock()
+
+	if !inFlight {
+		resp := call.do(req, rt)
+		c.mx.Lock()
+		delete(c.calls, key)
+		c.mx.Unlock()
+		close(call.done)
+		if resp != nil {
+			return resp, nil
+		}
+	} else {
+		log.Tracef("Collapsing request for %v", key)
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if call.tooLarge {
+			log.Tracef("Response for %v too large to share, sending request on its own", key)
+			return rt.RoundTrip(req)
+		}
+		if call.err == nil && !sameVary(call.resp.Header, call.header, req.Header) {
+			log.Tracef("Response for %v varies on what the requests differ in, sending request on its own", key)
+			return rt.RoundTrip(req)
+		}
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.copyResponse(req), nil
+}
+
+// sameVary tells whether the two requests have the same values for all the
+// headers in the Vary of the response
+func sameVary(respHeader, a, b http.Header) bool {
+	for _, v := range respHeader["Vary"] {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" {
+				return false
+			}
+			if field != "" && strings.Join(a.Values(field), ",") != strings.Join(b.Values(field), ",") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// do performs the round trip and buffers its response body. If the body is
+// too large, it returns the response with the body streamed from what was
+// buffered onwards.
+func (call *collapsedCall) do(req *http.Request, rt http.RoundTripper) *http.Response {
+	call.resp, call.err = rt.RoundTrip(req)
+	if call.err != nil || call.resp.Body == nil {
+		return nil
+	}
+	resp := call.resp
+	if resp.ContentLength > maxCollapsedBodyBytes {
+		call.tooLarge = true
+		return resp
+	}
+	call.body, call.err = ioutil.ReadAll(io.LimitReader(resp.Body, maxCollapsedBodyBytes+1))
+	if call.err == nil && len(call.body) > maxCollapsedBodyBytes {
+		call.tooLarge = true
+		resp.Body = &prefixedBody{io.MultiReader(bytes.NewReader(call.body), resp.Body), resp.Body}
+		return resp
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (call *collapsedCall) copyResponse(req *http.Request) *http.Response {
+	resp := new(http.Response)
+	*resp = *call.resp
+	resp.Request = req
+	resp.Header = cloneHeader(call.resp.Header)
+	resp.Trailer = cloneHeader(call.resp.Trailer)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(call.body))
+	return resp
+}
@@ -0,0 +1,224 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestCollapseRequests(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		// Give the other requests time to pile up
+		time.Sleep(300 * time.Millisecond)
+		w.Header().Set("X-Origin", "yes")
+		w.Write([]byte("expensive"))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:      30 * time.Second,
+		CollapseRequests: true,
+	}))
+
+	var wg sync.WaitGroup
+	var ok int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", origin.URL+"/resource", nil)
+			w := httptest.NewRecorder()
+			fwd.ServeHTTP(w, req)
+			if w.Code == http.StatusOK && w.Body.String() == "expensive" && w.Header().Get("X-Origin") == "yes" {
+				atomic.AddInt32(&ok, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&hits), "origin should have been hit once")
+	assert.EqualValues(t, 50, atomic.LoadInt32(&ok), "all requests should get the full response")
+
+	// Requests with credentials aren't collapsed
+	req, _ := http.NewRequest("GET", origin.URL+"/resource", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&hits))
+}
+
+func TestCollapseKeepsVariantsApart(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(300 * time.Millisecond)
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprintf(w, "%v %v %v", req.Host, req.Header.Get("Accept-Encoding"), req.Header.Get("Accept-Language"))
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:      30 * time.Second,
+		CollapseRequests: true,
+		Upstreams:        []*url.URL{originURL},
+	}))
+
+	tests := []struct {
+		host     string
+		encoding string
+		language string
+	}{
+		{"a.example", "gzip", "en"},
+		// Same upstream, other virtual host
+		{"b.example", "gzip", "en"},
+		{"a.example", "identity", "en"},
+		// Told apart by the Vary of the response
+		{"a.example", "gzip", "fr"},
+	}
+	var wg sync.WaitGroup
+	for _, test := range tests {
+		wg.Add(1)
+		go func(host, encoding, language string) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://"+host+"/resource", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			req.Header.Set("Accept-Language", language)
+			w := httptest.NewRecorder()
+			fwd.ServeHTTP(w, req)
+			assert.Equal(t, fmt.Sprintf("%v %v %v", host, encoding, language), w.Body.String(), "should get the response for its own request")
+		}(test.host, test.encoding, test.language)
+	}
+	wg.Wait()
+	assert.EqualValues(t, 4, atomic.LoadInt32(&hits))
+}
+
+func TestCollapsedRequestCancelled(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte("slow"))
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:      30 * time.Second,
+		CollapseRequests: true,
+	}))
+	go func() {
+		req, _ := http.NewRequest("GET", origin.URL+"/resource", nil)
+		fwd.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", origin.URL+"/resource", nil)
+	start := time.Now()
+	fwd.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	assert.True(t, time.Since(start) < time.Second, "shouldn't wait for the other request once cancelled")
+}
+
+func TestCollapseLargeResponse(t *testing.T) {
+	var hits int32
+	large := strings.Repeat("x", maxCollapsedBodyBytes+1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(300 * time.Millisecond)
+		if req.URL.Query().Get("length") == "" {
+			// Streamed, without a Content-Length
+			w.Header().Set("Transfer-Encoding", "chunked")
+		}
+		w.Write([]byte(large))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:      30 * time.Second,
+		CollapseRequests: true,
+	}))
+
+	for _, path := range []string{"/streamed", "/sized?length=1"} {
+		atomic.StoreInt32(&hits, 0)
+		var wg sync.WaitGroup
+		var ok int32
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("GET", origin.URL+path, nil)
+				w := httptest.NewRecorder()
+				fwd.ServeHTTP(w, req)
+				if w.Code == http.StatusOK && w.Body.String() == large {
+					atomic.AddInt32(&ok, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.EqualValues(t, 5, atomic.LoadInt32(&ok), "%v: all requests should get the full response", path)
+		assert.True(t, atomic.LoadInt32(&hits) > 1, "%v: requests shouldn't share a response too large to buffer", path)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	var mx sync.Mutex
+	hits := make(map[string]int)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user := req.Header.Get("X-User-Id")
+		mx.Lock()
+		hits[user]++
+		mx.Unlock()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("dashboard of " + user))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		CoalesceKey: func(req *http.Request) (string, bool) {
+			user := req.Header.Get("X-User-Id")
+			return user, user != ""
+		},
+	}))
+
+	var wg sync.WaitGroup
+	var ok int32
+	for i := 0; i < 20; i++ {
+		for _, user := range []string{"alice", "bob"} {
+			wg.Add(1)
+			go func(user string) {
+				defer wg.Done()
+				// Also POSTs, with the default key they wouldn't be collapsed
+				req, _ := http.NewRequest("POST", origin.URL+"/dashboard", nil)
+				req.Header.Set("X-User-Id", user)
+				w := httptest.NewRecorder()
+				fwd.ServeHTTP(w, req)
+				if w.Code == http.StatusOK && w.Body.String() == "dashboard of "+user {
+					atomic.AddInt32(&ok, 1)
+				}
+			}(user)
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, map[string]int{"alice": 1, "bob": 1}, hits, "each user should have hit the origin once")
+	assert.EqualValues(t, 40, atomic.LoadInt32(&ok), "all requests should get the response for their user")
+
+	// Without a key, requests are sent on their own
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", origin.URL+"/dashboard", nil)
+		fwd.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Equal(t, 2, hits[""])
+}
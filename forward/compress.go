@@ -0,0 +1,67 @@
+package forward
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// compressesFor tells whether bodies sent to the upstream should be gzipped:
+// all of them with CompressRequestBody, otherwise only those for the hosts in
+// CompressRequestBodyHosts.
+func (f *forwarder) compressesFor(u *url.URL) bool {
+	if f.CompressRequestBody {
+		return true
+	}
+	for _, h := range f.CompressRequestBodyHosts {
+		if strings.EqualFold(h, u.Host) || strings.EqualFold(h, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressBody gzips the body of the outbound request on the fly if its
+// upstream accepts compressed bodies. Bodies that are already encoded are left
+// alone. It returns a function that stops the compression if the body won't be
+// sent after all, and that returns once nothing reads the client body anymore.
+func (f *forwarder) compressBody(w http.ResponseWriter, outReq *http.Request) (stop func()) {
+	if outReq.Body == nil || outReq.Body == http.NoBody || outReq.ContentLength == 0 {
+		return func() {}
+	}
+	if outReq.Header.Get("Content-Encoding") != "" || !f.compressesFor(outReq.URL) {
+		return func() {}
+	}
+
+	body := outReq.Body
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gzw := gzip.NewWriter(pw)
+		_, err := io.Copy(gzw, body)
+		if err == nil {
+			err = gzw.Close()
+		}
+		// If the transport gave up on the body, this is a no-op
+		pw.CloseWithError(err)
+	}()
+
+	outReq.Body = pr
+	outReq.GetBody = nil
+	// The compressed length isn't known until it's all been sent
+	outReq.ContentLength = -1
+	outReq.Header.Del(ContentLength)
+	outReq.Header.Set("Content-Encoding", "gzip")
+
+	return func() {
+		// Fails the write the goroutine may be blocked on. One blocked reading
+		// from a slow client gets the deadline drainBody would set anyway.
+		pr.Close()
+		http.NewResponseController(w).SetReadDeadline(time.Now().Add(f.drainTimeout()))
+		<-done
+	}
+}
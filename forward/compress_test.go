@@ -0,0 +1,85 @@
+package forward
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestCompressRequestBody(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "gzip" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		gzr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(gzr)
+		w.Write(body)
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	}))
+	defer plain.Close()
+
+	// Both listen on the same IP, only the origin opted in, by port
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:              30 * time.Second,
+		CompressRequestBodyHosts: []string{originURL.Host},
+	}))
+
+	data := strings.Repeat("compress me ", 1000)
+	for _, u := range []string{origin.URL, plain.URL} {
+		req, _ := http.NewRequest("POST", u, strings.NewReader(data))
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, u)
+		assert.Equal(t, data, w.Body.String(), u)
+	}
+}
+
+func TestCompressRequestBodyUpstreamFailure(t *testing.T) {
+	bodies := make(chan io.Reader, 1)
+	rt := mockRT{func(req *http.Request) (*http.Response, error) {
+		// Fail without reading the body, leaving the compression blocked
+		bodies <- req.Body
+		return nil, errors.New("connection refused")
+	}}
+	client, closeProxy := proxiedClient(New(&Options{
+		IdleTimeout:         30 * time.Second,
+		RoundTripper:        rt,
+		CompressRequestBody: true,
+	}))
+	defer closeProxy()
+
+	req, _ := http.NewRequest("POST", "http://upstream.example.com/", strings.NewReader(strings.Repeat("compress me ", 10000)))
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+	_, err = (<-bodies).Read(make([]byte, 1))
+	assert.Equal(t, io.ErrClosedPipe, err, "compression should stop before the body gets drained")
+}
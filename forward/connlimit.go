@@ -0,0 +1,64 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var errUpstreamConnsExhausted = errors.New("Too many connections to upstreams")
+
+// connLimiter is a semaphore bounding the number of live upstream connections
+type connLimiter chan struct{}
+
+func newConnLimiter(max int) connLimiter {
+	return make(connLimiter, max)
+}
+
+// acquire waits for a connection slot for up to maxWait, or for as long as ctx
+// allows if maxWait is 0
+func (l connLimiter) acquire(ctx context.Context, maxWait time.Duration) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-timeout:
+		return errUpstreamConnsExhausted
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l connLimiter) release() {
+	<-l
+}
+
+// track returns a connection that gives its slot back when closed
+func (l connLimiter) track(conn net.Conn) net.Conn {
+	return &limitedConn{Conn: conn, limiter: l}
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter connLimiter
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.limiter.release)
+	return err
+}
@@ -0,0 +1,86 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestMaxUpstreamConns(t *testing.T) {
+	var mx sync.Mutex
+	open, maxOpen := 0, 0
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("hello"))
+	}))
+	origin.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		mx.Lock()
+		defer mx.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+			if open > maxOpen {
+				maxOpen = open
+			}
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:      30 * time.Second,
+		MaxUpstreamConns: 2,
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", origin.URL, nil)
+			w := httptest.NewRecorder()
+			fwd.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}()
+	}
+	wg.Wait()
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.True(t, maxOpen <= 2, "should never have more than 2 connections open, had %d", maxOpen)
+}
+
+func TestUpstreamConnsWait(t *testing.T) {
+	release := make(chan bool)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:       30 * time.Second,
+		MaxUpstreamConns:  1,
+		UpstreamConnsWait: 50 * time.Millisecond,
+	}))
+
+	go func() {
+		req, _ := http.NewRequest("GET", origin.URL+"/stall", nil)
+		fwd.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
@@ -0,0 +1,77 @@
+package forward
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/idletiming"
+)
+
+// labeledConn is an upstream connection numbered for LogUpstreamConns
+type labeledConn struct {
+	net.Conn
+	id     uint64
+	addr   string
+	closed sync.Once
+
+	// The connection wrapping this one to time it out, set right after
+	// dialing
+	idleConn *idletiming.IdleTimingConn
+}
+
+// labelConn numbers a newly dialed connection
+func (f *forwarder) labelConn(conn net.Conn) *labeledConn {
+	c := &labeledConn{Conn: conn, id: atomic.AddUint64(&f.connIDs, 1), addr: conn.RemoteAddr().String()}
+	log.Debugf("Upstream connection %d to %v dialed", c.id, c.addr)
+	return c
+}
+
+func (c *labeledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == io.EOF {
+		c.closed.Do(func() {
+			log.Debugf("Upstream connection %d to %v closed by the upstream", c.id, c.addr)
+		})
+	}
+	return n, err
+}
+
+func (c *labeledConn) Close() error {
+	c.closed.Do(func() {
+		if c.idleConn != nil && c.idleConn.TimesOutIn() <= 0 {
+			log.Debugf("Upstream connection %d to %v closed for being idle", c.id, c.addr)
+		} else {
+			log.Debugf("Upstream connection %d to %v closed", c.id, c.addr)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// withConnReuseLog logs when the request reuses a labeled connection
+func withConnReuseLog(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				return
+			}
+			conn := info.Conn
+			if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+				conn = tlsConn.NetConn()
+			}
+			if recycled, ok := conn.(*recycledConn); ok {
+				conn = recycled.Conn
+			}
+			if idleConn, ok := conn.(*idletiming.IdleTimingConn); ok {
+				conn = idleConn.Wrapped()
+			}
+			if c, ok := conn.(*labeledConn); ok {
+				log.Debugf("Upstream connection %d to %v reused", c.id, c.addr)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
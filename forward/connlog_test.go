@@ -0,0 +1,71 @@
+package forward
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+// syncBuffer is a buffer that's safe to log to from multiple goroutines
+type syncBuffer struct {
+	buf bytes.Buffer
+	mx  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+func TestLogUpstreamConns(t *testing.T) {
+	var errorOut, debugOut syncBuffer
+	reset := golog.SetOutputs(&errorOut, &debugOut)
+	defer reset()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	addr := origin.Listener.Addr().String()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 200 * time.Millisecond,
+		// Keep the transport from closing it first
+		IdleConnTimeout:  30 * time.Second,
+		LogUpstreamConns: true,
+	}))
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, "hello", w.Body.String())
+	}
+
+	expected := []string{"dialed", "reused", "closed for being idle"}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && !strings.Contains(debugOut.String(), "closed for being idle") {
+		time.Sleep(20 * time.Millisecond)
+	}
+	out := debugOut.String()
+	for _, event := range expected {
+		assert.Equal(t, 1, countLines(out, fmt.Sprintf("Upstream connection 1 to %v %v", addr, event)), "missing %v in %v", event, out)
+	}
+	assert.Equal(t, 0, countLines(out, "Upstream connection 2"), "connection should have been reused")
+}
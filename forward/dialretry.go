@@ -0,0 +1,45 @@
+package forward
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const defaultDialBackoff = 100 * time.Millisecond
+
+// dialWithRetries dials the upstream, trying again up to DialRetries times
+// with jittered exponential backoff if dialing fails
+func (f *forwarder) dialWithRetries(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := f.dial(ctx, network, addr)
+	for i := 0; err != nil && i < f.DialRetries; i++ {
+		wait := dialBackoff(f.DialBackoff, i)
+		log.Debugf("Unable to dial %v, retrying in %v: %v", addr, wait, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+		conn, err = f.dial(ctx, network, addr)
+	}
+	return conn, err
+}
+
+// dialBackoff is how long to wait before retry number i: base doubled i
+// times, randomized between half and all of that so that clients that failed
+// together don't retry together.
+func dialBackoff(base time.Duration, i int) time.Duration {
+	if base <= 0 {
+		base = defaultDialBackoff
+	}
+	d := base << uint(i)
+	if d <= 0 {
+		// Overflowed
+		d = base
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
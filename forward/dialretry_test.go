@@ -0,0 +1,72 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestDialRetries(t *testing.T) {
+	origin, _ := namedOrigin("origin")
+	defer origin.Close()
+
+	dials := 0
+	dialer := func(network, addr string) (net.Conn, error) {
+		dials++
+		if dials < 3 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		}
+		return net.Dial(network, addr)
+	}
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Dialer:      dialer,
+		DialRetries: 2,
+		DialBackoff: time.Millisecond,
+	}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "origin", w.Body.String())
+	assert.Equal(t, 3, dials)
+}
+
+func TestDialRetriesGiveUp(t *testing.T) {
+	dials := 0
+	dialer := func(network, addr string) (net.Conn, error) {
+		dials++
+		return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+	}
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Dialer:      dialer,
+		DialRetries: 2,
+		DialBackoff: time.Millisecond,
+	}))
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, 3, dials)
+}
+
+func TestDialBackoff(t *testing.T) {
+	base := 10 * time.Millisecond
+	for i := 0; i < 4; i++ {
+		max := base << uint(i)
+		for j := 0; j < 20; j++ {
+			d := dialBackoff(base, i)
+			assert.True(t, d >= max/2 && d <= max, "backoff %v of retry %d out of range", d, i)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver resolves hostnames to IP addresses. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCache resolves hosts with the given resolver, caching the results for
+// ttl (if positive).
+type dnsCache struct {
+	resolver Resolver
+	ttl      time.Duration
+	mx       sync.Mutex
+	entries  map[string]dnsEntry
+}
+
+func newDNSCache(resolver Resolver, ttl time.Duration) *dnsCache {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &dnsCache{
+		resolver: resolver,
+		ttl:      ttl,
+		entries:  make(map[string]dnsEntry),
+	}
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	if c.ttl > 0 {
+		c.mx.Lock()
+		entry, found := c.entries[host]
+		c.mx.Unlock()
+		if found && time.Now().Before(entry.expires) {
+			return entry.addrs, nil
+		}
+	}
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if c.ttl > 0 {
+		c.mx.Lock()
+		c.entries[host] = dnsEntry{addrs, time.Now().Add(c.ttl)}
+		c.mx.Unlock()
+	}
+	return addrs, nil
+}
+
+func (c *dnsCache) invalidate(host string) {
+	c.mx.Lock()
+	delete(c.entries, host)
+	c.mx.Unlock()
+}
+
+// dial dials the upstream with the configured Dialer, resolving its host
+// first if a Resolver or DNS cache is in use. The lookup is abandoned when ctx
+// is done.
+func (f *forwarder) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if f.dns == nil {
+		return f.Dialer(network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return f.Dialer(network, addr)
+	}
+
+	host = f.serviceName(host)
+	addrs, err := f.dns.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if f.HappyEyeballs > 0 {
+		conn, err := f.dialHappyEyeballs(network, host, addrs, port)
+		if err != nil {
+			f.dns.invalidate(host)
+		}
+		return conn, err
+	}
+	return f.dialSerial(network, host, addrs, port)
+}
+
+// serviceName qualifies single label hosts with the ServiceDomain, leaving IP
+// addresses alone
+func (f *forwarder) serviceName(host string) string {
+	if f.ServiceDomain == "" || strings.Contains(host, ".") || strings.EqualFold(host, "localhost") {
+		return host
+	}
+	if net.ParseIP(host) != nil {
+		// Like ::1, IPv6 addresses don't need to have dots
+		return host
+	}
+	return host + "." + strings.Trim(f.ServiceDomain, ".")
+}
+
+// dialSerial tries the addresses one after the other
+func (f *forwarder) dialSerial(network string, host string, addrs []string, port string) (net.Conn, error) {
+	var err error
+	for _, ip := range addrs {
+		var conn net.Conn
+		conn, err = f.Dialer(network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		log.Debugf("Unable to dial %v at %v: %v", host, ip, err)
+	}
+	// The addresses may be stale, resolve them again next time
+	f.dns.invalidate(host)
+	if err == nil {
+		err = &net.DNSError{Err: "no addresses", Name: host}
+	}
+	return nil, err
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs dials the addresses of the same family as the first one,
+// and after the HappyEyeballs delay (or as soon as those fail) the addresses
+// of the other family in parallel, as described in RFC 6555.
+func (f *forwarder) dialHappyEyeballs(network string, host string, addrs []string, port string) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host}
+	}
+	var primaries, fallbacks []string
+	for _, ip := range addrs {
+		if len(primaries) == 0 || isIPv4(ip) == isIPv4(primaries[0]) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+
+	results := make(chan dialResult, 2)
+	dialAll := func(ips []string) {
+		var err error
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = f.Dialer(network, net.JoinHostPort(ip, port))
+			if err == nil {
+				results <- dialResult{conn, nil}
+				return
+			}
+		}
+		results <- dialResult{nil, err}
+	}
+
+	go dialAll(primaries)
+	racing := 1
+	var fallbackTimer <-chan time.Time
+	if len(fallbacks) > 0 {
+		timer := time.NewTimer(f.HappyEyeballs)
+		defer timer.Stop()
+		fallbackTimer = timer.C
+	}
+	startFallback := func() {
+		fallbackTimer = nil
+		racing++
+		go dialAll(fallbacks)
+	}
+
+	var err error
+	for {
+		select {
+		case <-fallbackTimer:
+			startFallback()
+		case result := <-results:
+			racing--
+			if result.err == nil {
+				if racing > 0 {
+					// Close the connection of the slower family if it eventually succeeds
+					go func() {
+						if loser := <-results; loser.conn != nil {
+							loser.conn.Close()
+						}
+					}()
+				}
+				return result.conn, nil
+			}
+			err = result.err
+			if fallbackTimer != nil {
+				// Don't wait any longer for the other family
+				startFallback()
+			} else if racing == 0 {
+				return nil, err
+			}
+		}
+	}
+}
+
+func isIPv4(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() != nil
+}
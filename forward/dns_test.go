@@ -0,0 +1,265 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+type countingResolver struct {
+	lookups int32
+	addrs   []string
+}
+
+func (r *countingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	return r.addrs, nil
+}
+
+// stuckResolver never answers, until the lookup is abandoned
+type stuckResolver struct {
+	values    chan interface{}
+	abandoned chan error
+}
+
+func (r *stuckResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.values <- ctx.Value(resolverKey{})
+	<-ctx.Done()
+	r.abandoned <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+type resolverKey struct{}
+
+func TestResolverContext(t *testing.T) {
+	resolver := &stuckResolver{make(chan interface{}, 1), make(chan error, 1)}
+	forwarder := New(&Options{
+		IdleTimeout:           30 * time.Second,
+		Resolver:              resolver,
+		DefaultRequestTimeout: 100 * time.Millisecond,
+	}).(*forwarder)
+	fwd := filters.Join(forwarder)
+
+	req, _ := http.NewRequest("GET", "http://upstream.test/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), resolverKey{}, "value"))
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, "value", <-resolver.values, "lookup should get the context of the dial")
+
+	// The transport lets dials outlive requests, until it gives up on them
+	forwarder.RoundTripper.(*http.Transport).CloseIdleConnections()
+	select {
+	case err := <-resolver.abandoned:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "lookup should have been abandoned")
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Force a new dial for every request
+		w.Header().Set("Connection", "close")
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+	target := "http://upstream.test:" + port + "/"
+
+	var failDial int32
+	resolver := &countingResolver{addrs: []string{"127.0.0.1"}}
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Resolver:    resolver,
+		DNSCacheTTL: time.Minute,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			if atomic.LoadInt32(&failDial) == 1 {
+				return nil, errors.New("intentionally fail")
+			}
+			return net.Dial(network, addr)
+		},
+	}))
+
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, "hello", w.Body.String())
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&resolver.lookups), "should have resolved once within the TTL")
+
+	// A failed dial invalidates the cached entry
+	atomic.StoreInt32(&failDial, 1)
+	req, _ := http.NewRequest("GET", target, nil)
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+	atomic.StoreInt32(&failDial, 0)
+	req, _ = http.NewRequest("GET", target, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, "hello", w.Body.String())
+	assert.EqualValues(t, 2, atomic.LoadInt32(&resolver.lookups), "should have resolved again after the dial failure")
+}
+
+type serviceResolver map[string][]string
+
+func (r serviceResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, found := r[host]
+	if !found {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestServiceDomain(t *testing.T) {
+	received := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Host
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:   30 * time.Second,
+		ServiceDomain: "default.svc.cluster.local.",
+		Resolver: serviceResolver{
+			"my-svc.default.svc.cluster.local": {"127.0.0.1"},
+			"my-svc.example.com":               {"127.0.0.1"},
+		},
+	}))
+
+	for _, host := range []string{"my-svc", "my-svc.example.com"} {
+		req, _ := http.NewRequest("GET", "http://"+host+":"+port+"/path", nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, "hello", w.Body.String(), host)
+		assert.Equal(t, host+":"+port, <-received, "the Host header should be left alone")
+	}
+
+	// Only single labels get qualified
+	req, _ := http.NewRequest("GET", "http://other-svc.prod:"+port+"/path", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+
+	f := &forwarder{Options: &Options{ServiceDomain: "default.svc.cluster.local"}}
+	assert.Equal(t, "my-svc.default.svc.cluster.local", f.serviceName("my-svc"))
+	assert.Equal(t, "localhost", f.serviceName("localhost"))
+	assert.Equal(t, "my-svc.prod", f.serviceName("my-svc.prod"))
+	assert.Equal(t, "::1", f.serviceName("::1"))
+	assert.Equal(t, "fe80::1", f.serviceName("fe80::1"))
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	blackhole := make(chan struct{})
+	defer close(blackhole)
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:   30 * time.Second,
+		Resolver:      &countingResolver{addrs: []string{"2001:db8::1", "127.0.0.1"}},
+		HappyEyeballs: 50 * time.Millisecond,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			host, _, _ := net.SplitHostPort(addr)
+			if !isIPv4(host) {
+				// Simulate an IPv6 route that silently drops packets
+				select {
+				case <-blackhole:
+				case <-time.After(5 * time.Second):
+				}
+				return nil, errors.New("timed out")
+			}
+			return net.Dial(network, addr)
+		},
+	}))
+
+	req, _ := http.NewRequest("GET", "http://dualstack.test:"+port+"/", nil)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, "hello", w.Body.String())
+	assert.True(t, time.Now().Sub(start) < time.Second, "should have quickly fallen back to IPv4")
+}
+
+// mockDoH answers DoH queries for A records from the given ones
+func mockDoH(t *testing.T, records map[string][4]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/dns-message", req.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(req.Body)
+		var query dnsmessage.Message
+		if !assert.NoError(t, query.Unpack(body)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q := query.Questions[0]
+		reply := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true},
+			Questions: query.Questions,
+		}
+		a, found := records[q.Name.String()]
+		switch {
+		case !found:
+			reply.RCode = dnsmessage.RCodeNameError
+		case q.Type == dnsmessage.TypeA:
+			reply.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: a},
+			}}
+		}
+		packed, _ := reply.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+}
+
+func TestDoHResolver(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	doh := mockDoH(t, map[string][4]byte{"upstream.test.": {127, 0, 0, 1}})
+	defer doh.Close()
+
+	resolver := DoHResolver(doh.URL)
+	addrs, err := resolver.LookupHost(context.Background(), "upstream.test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"127.0.0.1"}, addrs)
+	}
+	_, err = resolver.LookupHost(context.Background(), "unknown.test")
+	var dnsErr *net.DNSError
+	if assert.True(t, errors.As(err, &dnsErr)) {
+		assert.True(t, dnsErr.IsNotFound)
+	}
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Resolver:    resolver,
+	}))
+	req, _ := http.NewRequest("GET", "http://upstream.test:"+port+"/", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, "hello", w.Body.String())
+}
@@ -0,0 +1,109 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dohContentType    = "application/dns-message"
+	maxDoHMessageSize = 65535
+)
+
+// dohResolver resolves hostnames with DNS over HTTPS
+type dohResolver struct {
+	endpoint string
+	client   *http.Client
+}
+
+// DoHResolver returns a Resolver that resolves hostnames with DNS over HTTPS
+// (RFC 8484) at the given endpoint, e.g. "https://cloudflare-dns.com/dns-query",
+// for use as Options.Resolver. The host of the endpoint itself is resolved by
+// the system, so it's best given as an IP address.
+func DoHResolver(endpoint string) Resolver {
+	return &dohResolver{endpoint: endpoint, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// LookupHost returns the IPv4 addresses of the host followed by its IPv6
+// ones.
+func (r *dohResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	var addrs []string
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := r.query(ctx, name, qtype)
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: host, Server: r.endpoint}
+		}
+		addrs = append(addrs, answers...)
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.endpoint, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// query asks the DoH server for the records of the given type, returning the
+// addresses in them
+func (r *dohResolver) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]string, error) {
+	// An ID of 0 makes responses cacheable by HTTP caches, see section 4.1
+	// of RFC 8484
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server responded %v", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDoHMessageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var reply dnsmessage.Message
+	if err := reply.Unpack(body); err != nil {
+		return nil, fmt.Errorf("Invalid DoH response: %v", err)
+	}
+	switch reply.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, fmt.Errorf("DoH server failed with %v", reply.RCode)
+	}
+	var addrs []string
+	for _, answer := range reply.Answers {
+		// Any CNAMEs come along with the records they point to
+		switch rr := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, net.IP(rr.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, net.IP(rr.AAAA[:]).String())
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,66 @@
+package forward
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultMaxDrainBytes = 1 << 20
+	defaultDrainTimeout  = 5 * time.Second
+)
+
+func (f *forwarder) maxDrainBytes() int64 {
+	if f.MaxDrainBytes == 0 {
+		return defaultMaxDrainBytes
+	}
+	return f.MaxDrainBytes
+}
+
+func (f *forwarder) drainTimeout() time.Duration {
+	if f.RequestBodyTimeout <= 0 {
+		return defaultDrainTimeout
+	}
+	return f.RequestBodyTimeout
+}
+
+// keepOpenBody shields the client body from the transport, which closes it
+// when the round trip fails and would leave the rest of it unread. The server
+// closes it once the request has been handled.
+type keepOpenBody struct {
+	io.ReadCloser
+}
+
+func (b keepOpenBody) Close() error {
+	return nil
+}
+
+// drainBody discards what the upstream didn't read of the client body, up to
+// MaxDrainBytes, giving the client RequestBodyTimeout (5 seconds by default)
+// to send it. The server only does it for small leftovers and closes the
+// connection otherwise.
+func (f *forwarder) drainBody(w http.ResponseWriter, req *http.Request) {
+	max := f.maxDrainBytes()
+	if max <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Now().Add(f.drainTimeout())); err != nil {
+		// Not without a deadline, a slow client would hold up the response
+		log.Debugf("Not draining request body: %v", err)
+		return
+	}
+	// Otherwise the deadline still bounds what the server reads of the body
+	// before writing the response
+	n, err := io.CopyN(ioutil.Discard, req.Body, max)
+	switch err {
+	case io.EOF:
+		rc.SetReadDeadline(time.Time{})
+	case nil:
+		log.Debugf("Request body still not fully read after draining %d bytes", n)
+	default:
+		log.Debugf("Unable to drain request body: %v", err)
+	}
+}
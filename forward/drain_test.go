@@ -0,0 +1,81 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestDrainBodyOnError(t *testing.T) {
+	// Fails before reading any of the body
+	origin := httptest.NewServer(http.NotFoundHandler())
+	origin.Close()
+
+	// Bigger than what net/http drains by itself
+	body := bytes.Repeat([]byte("a"), 512*1024)
+	post := func(fwd filters.Filter) []bool {
+		client, stop := proxiedClient(fwd)
+		defer stop()
+		var reused []bool
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("POST", origin.URL, bytes.NewReader(body))
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+				reused = append(reused, info.Reused)
+			}}
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+			resp, err := client.Do(req)
+			if assert.NoError(t, err) {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+			}
+		}
+		return reused
+	}
+
+	assert.Equal(t, []bool{false, true}, post(New(&Options{IdleTimeout: 30 * time.Second})),
+		"client connection should be reused after the upstream failed")
+	assert.Equal(t, []bool{false, false}, post(New(&Options{IdleTimeout: 30 * time.Second, MaxDrainBytes: -1})),
+		"client connection shouldn't be reused without draining")
+}
+
+func TestDrainBodyDeadline(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	origin.Close()
+
+	for timeout, expected := range map[time.Duration]time.Duration{
+		200 * time.Millisecond: 200 * time.Millisecond,
+		0:                      defaultDrainTimeout,
+	} {
+		proxy := httptest.NewServer(filters.Join(New(&Options{
+			IdleTimeout:        30 * time.Second,
+			RequestBodyTimeout: timeout,
+		})))
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if assert.NoError(t, err) {
+			// Stalls after the first bit of the body
+			fmt.Fprintf(conn, "POST %v HTTP/1.1\r\nHost: %v\r\nContent-Length: 100000\r\n\r\nsome of it", origin.URL, origin.Listener.Addr())
+			conn.SetReadDeadline(time.Now().Add(expected + 5*time.Second))
+			start := time.Now()
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if assert.NoError(t, err, "should get a response without sending the whole body") {
+				resp.Body.Close()
+				assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+				assert.True(t, time.Since(start) < expected+time.Second, "should have given up draining after %v", expected)
+			}
+			conn.Close()
+		}
+		proxy.Close()
+	}
+}
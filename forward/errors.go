@@ -0,0 +1,90 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DialError is the error the forwarder fails with when it can't connect to
+// the upstream. It wraps the error from the Dialer.
+type DialError struct {
+	Addr string
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("Unable to dial %v: %v", e.Addr, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout implements net.Error
+func (e *DialError) Timeout() bool {
+	netErr, ok := e.Err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Temporary implements net.Error
+func (e *DialError) Temporary() bool {
+	return false
+}
+
+// TimeoutError is the error the forwarder fails with when the upstream
+// connection times out after it has been established.
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Timed out talking to upstream: %v", e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout implements net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary implements net.Error
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+// InvalidResponseError is the error the forwarder fails with when the
+// upstream's response is malformed in a way that makes it unsafe to forward.
+type InvalidResponseError struct {
+	Err error
+}
+
+func (e *InvalidResponseError) Error() string {
+	return fmt.Sprintf("Invalid response from upstream: %v", e.Err)
+}
+
+func (e *InvalidResponseError) Unwrap() error {
+	return e.Err
+}
+
+// classifyRoundTripError wraps timeouts in a TimeoutError and the errors
+// about malformed responses in an InvalidResponseError. Dial errors are
+// already typed as such by the dialer.
+func classifyRoundTripError(err error) error {
+	switch e := err.(type) {
+	case *DialError, *TimeoutError, *InvalidResponseError:
+		return err
+	case net.Error:
+		if e.Timeout() {
+			return &TimeoutError{err}
+		}
+	}
+	// net/http doesn't export the errors for malformed responses
+	if strings.Contains(err.Error(), "multiple Content-Length headers") {
+		return &InvalidResponseError{err}
+	}
+	return err
+}
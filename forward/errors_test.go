@@ -0,0 +1,65 @@
+package forward
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+	"github.com/getlantern/http-proxy/utils"
+)
+
+func TestDialError(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	var rtErr error
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		ErrorStatusMapper: func(err error) int {
+			rtErr = err
+			return utils.StatusForError(err)
+		},
+	}))
+	req, _ := http.NewRequest("GET", closed.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	var dialErr *DialError
+	if assert.True(t, errors.As(rtErr, &dialErr), "should fail with a DialError, not %v", rtErr) {
+		assert.Equal(t, req.URL.Host, dialErr.Addr)
+		assert.Contains(t, dialErr.Err.Error(), "connection refused")
+	}
+	var timeoutErr *TimeoutError
+	assert.False(t, errors.As(rtErr, &timeoutErr))
+}
+
+func TestTimeoutError(t *testing.T) {
+	release := make(chan bool)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	var rtErr error
+	fwd := filters.Join(New(&Options{
+		RoundTripper: &http.Transport{ResponseHeaderTimeout: 50 * time.Millisecond},
+		ErrorStatusMapper: func(err error) int {
+			rtErr = err
+			return utils.StatusForError(err)
+		},
+	}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	var timeoutErr *TimeoutError
+	assert.True(t, errors.As(rtErr, &timeoutErr), "should fail with a TimeoutError, not %v", rtErr)
+}
@@ -0,0 +1,61 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flushingWriter flushes what's written to the client at most latency after
+// writing it, so that streamed responses don't sit in the server's buffers. A
+// negative latency flushes after every write.
+type flushingWriter struct {
+	dst          io.Writer
+	flusher      http.Flusher
+	latency      time.Duration
+	mx           sync.Mutex
+	timer        *time.Timer
+	flushPending bool
+}
+
+func (w *flushingWriter) Write(p []byte) (int, error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	n, err := w.dst.Write(p)
+	if w.latency < 0 {
+		w.flusher.Flush()
+		return n, err
+	}
+	if w.flushPending {
+		return n, err
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.latency, w.delayedFlush)
+	} else {
+		w.timer.Reset(w.latency)
+	}
+	w.flushPending = true
+	return n, err
+}
+
+func (w *flushingWriter) delayedFlush() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if !w.flushPending {
+		// stop was called in the meantime
+		return
+	}
+	w.flusher.Flush()
+	w.flushPending = false
+}
+
+// stop cancels any pending flush. The caller must not write afterwards.
+func (w *flushingWriter) stop() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.flushPending = false
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
@@ -0,0 +1,69 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+// flushRecorder records how much of the body had been written at each flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushedAt []int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushedAt = append(r.flushedAt, r.Body.Len())
+	r.ResponseRecorder.Flush()
+}
+
+func TestStreamChunkSize(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:     30 * time.Second,
+		FlushInterval:   -1,
+		StreamChunkSize: 4,
+	}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, "0123456789", w.Body.String())
+	assert.Equal(t, []int{4, 8, 10}, w.flushedAt, "should flush every chunk")
+}
+
+func TestFlushInterval(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("second"))
+	}))
+	defer origin.Close()
+
+	client, closeProxy := proxiedClient(New(&Options{
+		IdleTimeout:   30 * time.Second,
+		FlushInterval: 10 * time.Millisecond,
+	}))
+	defer closeProxy()
+
+	start := time.Now()
+	resp, err := client.Get(origin.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 5)
+	_, err = resp.Body.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(buf))
+	assert.True(t, time.Now().Sub(start) < 150*time.Millisecond, "first part should be flushed before the rest arrives")
+}
@@ -1,11 +1,19 @@
 package forward
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/golog"
@@ -23,16 +31,540 @@ type Options struct {
 	Rewriter     RequestRewriter
 	Dialer       func(network, address string) (net.Conn, error)
 	RoundTripper http.RoundTripper
+
+	// SharedTransport lets several forwarders share a single transport, and
+	// thus its pool of idle connections, instead of each building its own.
+	// http.Transport is safe for concurrent use, but since it's configured by
+	// the caller, the Dialer and IdleTimeout options don't apply to it. It's
+	// ignored if RoundTripper is set.
+	SharedTransport *http.Transport
+
+	// Router picks the route of each request, along with route specific
+	// settings. Requests for which it returns nil are routed by the other
+	// options.
+	Router func(req *http.Request) *Route
+
+	// RetryBudget caps the retries of Routes across all requests, so that
+	// retries don't pile up on a struggling upstream: every request earns this
+	// fraction of a retry (e.g. 0.2 allows retrying one request in five), with
+	// a reserve of 10 retries for bursts. Without it, retries are only limited
+	// per request.
+	RetryBudget float64
+
+	// RouteByContentType maps request media types (e.g. "multipart/form-data")
+	// to the upstream that should receive them. Requests with other content
+	// types go to the host they were addressed to.
+	RouteByContentType map[string]*url.URL
+
+	// RouteBySNI maps the server names clients asked for in the TLS handshake
+	// of inbound connections (see SNI) to the upstream that should receive
+	// their requests. It takes precedence over RouteByPriority and
+	// RouteByContentType.
+	RouteBySNI map[string]*url.URL
+
+	// RouteByPriority maps lower case values of the PriorityHeader (matched
+	// case insensitively, e.g. "high") to the upstream that should receive
+	// the requests with them, so that they can get a dedicated pool. Requests
+	// with other or no priority are routed as usual. PriorityHeader defaults
+	// to Priority. It takes precedence over RouteByContentType.
+	RouteByPriority map[string]*url.URL
+	PriorityHeader  string
+
+	// Upstreams, when set, receive the requests in round robin instead of the
+	// host they were addressed to. An upstream that fails is taken out of
+	// rotation for UpstreamCooldown (10 seconds by default). If all of them are
+	// down, requests get a 503 with a Retry-After header.
+	Upstreams        []*url.URL
+	UpstreamCooldown time.Duration
+
+	// HealthCheck, if set, actively checks the health of the Upstreams,
+	// taking those that fail out of rotation until they recover.
+	HealthCheck *HealthCheck
+
+	// BandwidthQuota, if set, limits how much each client can transfer.
+	BandwidthQuota *BandwidthQuota
+
+	// OutlierDetection, if set, takes Upstreams out of rotation based on
+	// their error rate, instead of for UpstreamCooldown after every failure.
+	OutlierDetection *OutlierDetection
+
+	// WeightedUpstreams adds upstreams (keyed by URL) that get a share of the
+	// requests proportional to their weight. Upstreams get a weight of 1.
+	WeightedUpstreams map[string]int
+
+	// RewriteLocationHeader rewrites redirects pointing at an internal host so
+	// that they point at the public one instead.
+	RewriteLocationHeader *LocationRewrite
+
+	// RewriteCookies rewrites the Domain and Path of cookies set by the upstream
+	// so that they work on the public domain.
+	RewriteCookies *CookieRewrite
+
+	// MaxResponseHeaders caps the number of header lines forwarded from the
+	// upstream response. Extra headers are dropped, unless
+	// StrictResponseHeaders is set, in which case the response is rejected
+	// with a 502.
+	MaxResponseHeaders    int
+	StrictResponseHeaders bool
+
+	// ForwardClientCert passes the details of the certificate presented by the
+	// client over TLS to the upstream in the X-Client-Cert-* headers.
+	ForwardClientCert bool
+
+	// ProtoVersionHeader, if set, is the request header in which the version
+	// of the protocol the client used (e.g. "HTTP/1.0" or "HTTP/2.0") is sent
+	// upstream, since outbound requests always go out as HTTP/1.1 or HTTP/2
+	// depending on the transport. XForwardedProtoVersion is the usual choice.
+	ProtoVersionHeader string
+
+	// Authorize, if set, is called before forwarding each request. Requests
+	// that aren't allowed get the returned status (403 if none) and message
+	// without reaching the upstream.
+	Authorize func(req *http.Request) (allowed bool, status int, msg string)
+
+	// FallbackToNextOnError continues down the filter chain instead of failing
+	// when the upstream can't be reached, so that the next filter can serve
+	// cached or static content.
+	FallbackToNextOnError bool
+
+	// LogSampleRate only writes the access log for 1 in every LogSampleRate
+	// successful requests, to keep log volume down at high request rates.
+	// Errors are always logged.
+	LogSampleRate int
+
+	// AccessLogLevel is the level the access log for successful requests is
+	// written at, debug by default. Use LogLevelTrace to only get it when
+	// tracing is enabled.
+	AccessLogLevel LogLevel
+
+	// AsyncAccessLog, if positive, writes the access log from a background
+	// goroutine instead of the request's, queueing up to this many entries.
+	// Entries that don't fit in the queue are dropped, and OnAccessLogDrop is
+	// called with the number of entries dropped so far.
+	AsyncAccessLog  int
+	OnAccessLogDrop func(dropped uint64)
+
+	// MaxDrainBytes is how much of the rest of the request body is read and
+	// discarded when forwarding fails, so that the client connection can be
+	// reused rather than closed. It defaults to 1MB, negative disables it.
+	// Draining holds up the error response, for no longer than
+	// RequestBodyTimeout, or 5 seconds if that's not set, after which the
+	// connection is closed instead.
+	MaxDrainBytes int64
+
+	// MaxURILength rejects requests whose URI is longer than this many bytes
+	// with a 414, without contacting the upstream.
+	MaxURILength int
+
+	// MaxUpstreamHeaderBytes caps the size of the headers of outbound
+	// requests, after they've been rewritten and gone through OnRequest.
+	// Requests that exceed it get a 500, since it's the proxy's fault, rather
+	// than being sent to upstreams that would reject them.
+	MaxUpstreamHeaderBytes int
+
+	// ErrorStatusMapper decides which status to respond with when forwarding
+	// to the upstream fails. If not set, errors go to the filter chain's error
+	// handler, which uses utils.StatusForError.
+	ErrorStatusMapper func(err error) int
+
+	// CollapseRequests makes concurrent identical GET and HEAD requests (same
+	// method, URL, Host and Accept-Encoding) share a single round trip to the
+	// upstream, with the buffered response fanned out to all of them, unless
+	// its Vary tells them apart. Responses with bodies over
+	// 1MB aren't buffered, they're streamed to the first request and the
+	// others are sent on their own. Requests carrying credentials
+	// (Authorization or Cookie) are never collapsed.
+	CollapseRequests bool
+
+	// CoalesceKey, if set, decides which requests share a round trip instead
+	// of CollapseRequests: concurrent requests for which it returns the same
+	// key get the response of the first one, e.g. keyed on a user id header
+	// for expensive personalized responses. Requests for which it returns
+	// false are sent on their own. It's called with the outbound request, and
+	// it's up to it to only coalesce requests that can get the same response.
+	CoalesceKey func(req *http.Request) (key string, ok bool)
+
+	// BlockTrace rejects TRACE requests with a 405, since they can be used to
+	// reflect headers (like cookies) back to the client.
+	BlockTrace bool
+
+	// LocalOptions, if set, answers OPTIONS requests locally instead of
+	// forwarding them.
+	LocalOptions http.HandlerFunc
+
+	// Maintenance, while set to true, puts the forwarder in maintenance mode:
+	// requests aren't forwarded, they get MaintenanceResponse instead, or a
+	// plain 503 if it isn't set. It can be flipped at any time.
+	Maintenance         *atomic.Bool
+	MaintenanceResponse func(w http.ResponseWriter)
+
+	// UpstreamFraming controls how request bodies are framed when sent to the
+	// upstream. By default the framing of the original request is kept.
+	UpstreamFraming Framing
+
+	// DisableRequestTrailers drops the trailers of requests instead of
+	// forwarding them after the body, for upstreams that choke on them.
+	DisableRequestTrailers bool
+
+	// BufferRequestBody reads request bodies fully before forwarding them,
+	// for upstreams that can't take streamed uploads (e.g. serverless
+	// functions). They're sent with a Content-Length and without trailers.
+	// Bodies larger than MaxRequestBodyBytes (10MB by default) get a 413, as
+	// do those of unknown length with FramingContentLength.
+	BufferRequestBody   bool
+	MaxRequestBodyBytes int64
+
+	// Resolver, if set, is used to resolve upstream hostnames before dialing
+	// them. Defaults to net.DefaultResolver when DNSCacheTTL is set.
+	Resolver Resolver
+
+	// ServiceDomain, if set, is appended to upstream hostnames without any
+	// dots (other than localhost) before resolving them, so that service names
+	// like my-svc in http://my-svc/path resolve within a cluster, e.g. with
+	// "default.svc.cluster.local" for Kubernetes. Only the resolution changes,
+	// the Host header stays as the client sent it.
+	ServiceDomain string
+
+	// DNSCacheTTL caches resolved upstream addresses for this long, so that
+	// repeated requests to the same hosts don't resolve them every time.
+	// Entries are invalidated when dialing all of their addresses fails.
+	DNSCacheTTL time.Duration
+
+	// SendProxyProtocol writes a PROXY protocol header (version 1 or 2) on each
+	// connection dialed to the upstream, so that it learns the address of the
+	// client. Since that's specific to each client, upstream connections
+	// aren't reused when this is enabled.
+	SendProxyProtocol int
+
+	// FirstByteTimeout bounds the time from sending the request to receiving
+	// the first byte of the response body, failing with a 504 if exceeded.
+	// It catches upstreams that send headers promptly but then stall.
+	FirstByteTimeout time.Duration
+
+	// HeaderReadTimeout bounds the time from finishing sending the request to
+	// receiving the complete header block of the response, failing with a 504
+	// if exceeded, so that upstreams trickling their headers fail fast. It
+	// works with any RoundTripper and leaves the body unbounded.
+	HeaderReadTimeout time.Duration
+
+	// DropRequestHeaders and DropResponseHeaders list headers (matched case
+	// insensitively) that are removed before forwarding the request to the
+	// upstream and the response to the client respectively.
+	DropRequestHeaders  []string
+	DropResponseHeaders []string
+
+	// HappyEyeballs races connections to the IPv6 and IPv4 addresses of dual
+	// stack upstreams, giving the first address family a head start of this
+	// long, and uses whichever connects first.
+	HappyEyeballs time.Duration
+
+	// ConnectionPolicy decides for each request whether it may share its
+	// connection to the upstream with other requests. When it returns false
+	// the request is sent on a connection of its own, closed after the
+	// response (e.g. because it's bound to the credentials of this one). With
+	// a custom RoundTripper, the request only asks for the connection to be
+	// closed.
+	ConnectionPolicy func(req *http.Request) (reuse bool)
+
+	// OnRequest is called with the outbound request right before it's sent
+	// upstream, and OnResponse with the upstream's response before it's
+	// forwarded. The outbound request carries the context of the original one,
+	// so values set by earlier filters are available from outReq.Context()
+	// and resp.Request.Context().
+	OnRequest  func(outReq *http.Request)
+	OnResponse func(resp *http.Response)
+
+	// UpstreamContextKey, if set, is the context key under which the address
+	// (host:port or host) of the upstream chosen for the request is stored,
+	// so that OnRequest, OnResponse and logging can tell which backend served
+	// it.
+	UpstreamContextKey interface{}
+
+	// UpstreamHTTP2 makes the default transport talk HTTP/2 to HTTPS upstreams
+	// that support it.
+	UpstreamHTTP2 bool
+
+	// UpstreamH2C makes the default transport talk HTTP/2 with prior knowledge
+	// (h2c) to plain HTTP upstreams, as needed for proxying gRPC. HTTPS
+	// upstreams must support HTTP/2 too.
+	UpstreamH2C bool
+
+	// UpstreamHostHeader sends requests routed to an upstream with the
+	// upstream's host as the Host header (the :authority pseudo-header over
+	// HTTP/2), instead of the host the client asked for.
+	UpstreamHostHeader bool
+
+	// FlushInterval makes the forwarder flush the response body to the client
+	// at this interval while it's being copied, instead of leaving it to the
+	// server's buffering. A negative value flushes after every write.
+	FlushInterval time.Duration
+
+	// StreamChunkSize is the size of the reads from the upstream, and so of
+	// the writes to the client, when FlushInterval is set. Small chunks get
+	// flushed promptly at the expense of throughput. Defaults to the size of
+	// the shared buffers.
+	StreamChunkSize int
+
+	// IdleConnTimeout is how long the default transport keeps unused
+	// connections in its pool before closing them. It defaults to IdleTimeout,
+	// which on its own applies to connections that stall mid-request too.
+	IdleConnTimeout time.Duration
+
+	// FallbackOnStatus lists upstream response codes (e.g. 404) upon which
+	// the request is retried against FallbackUpstream, whose response is then
+	// forwarded instead. Only requests that can be safely resent are retried:
+	// those without a body or whose body can be replayed.
+	FallbackOnStatus []int
+	FallbackUpstream *url.URL
+
+	// MaxUpstreamConns caps the number of live connections the default
+	// transport keeps open to all upstreams together, idle or not. Requests
+	// that need a new connection beyond that wait for one to be closed, for
+	// up to UpstreamConnsWait if set, after which they get a 503.
+	MaxUpstreamConns  int
+	UpstreamConnsWait time.Duration
+
+	// RefererPolicy controls what upstreams get to see of the Referer of
+	// requests, passing it through by default.
+	RefererPolicy RefererPolicy
+
+	// CleanPath normalizes the path of requests on their way upstream,
+	// collapsing duplicate slashes and resolving "." and ".." segments, for
+	// upstreams that could be confused by them. RejectPathTraversal rejects
+	// requests with "." or ".." segments (encoded or not) with a 400 instead.
+	CleanPath           bool
+	RejectPathTraversal bool
+
+	// RewritePath rewrites the path of requests on their way upstream.
+	RewritePath *PathRewrite
+
+	// MethodRewrite maps request methods to the ones to use upstream (e.g.
+	// a legacy verb to POST). The body is forwarded as is.
+	MethodRewrite map[string]string
+
+	// BufferSmallResponses buffers responses of unknown length up to this many
+	// bytes so that they can be sent with a Content-Length instead of chunked.
+	// Larger responses are streamed as usual.
+	BufferSmallResponses int
+
+	// NormalizeErrorBody rewrites the bodies of error responses (4xx and 5xx)
+	// of the NormalizeErrorTypes media types (application/json by default),
+	// e.g. to wrap them in a common envelope. Encoded bodies and bodies larger
+	// than 64KB are forwarded as is.
+	NormalizeErrorBody  func(status int, body []byte) []byte
+	NormalizeErrorTypes []string
+
+	// ConsistentHash makes the forwarder pick upstreams by consistent hashing
+	// of the key it returns for each request (e.g. the URL path), instead of
+	// round robin, so that requests with the same key keep going to the same
+	// upstream for cache affinity.
+	ConsistentHash func(req *http.Request) string
+
+	// RequestBodyTimeout fails requests with a 408 when the client stops
+	// sending the request body for this long, instead of holding on to the
+	// upstream connection.
+	RequestBodyTimeout time.Duration
+
+	// HonorClientTimeout takes the deadline of requests from their
+	// X-Request-Timeout (seconds, or a duration like "500ms") or grpc-timeout
+	// header. Clients can only shorten the timeout they'd get otherwise, from
+	// their Route or DefaultRequestTimeout, unless MaxClientTimeout is set, in
+	// which case they can ask for up to that long.
+	HonorClientTimeout bool
+	MaxClientTimeout   time.Duration
+
+	// DefaultRequestTimeout bounds the exchange with the upstream of requests
+	// that get no timeout from their Route, so that none of them runs
+	// unbounded. Requests that don't get a response in time fail
+	// with a 504.
+	DefaultRequestTimeout time.Duration
+
+	// HeadFallbackToGet retries HEAD requests as GET when the upstream
+	// responds 405 to them, for upstreams that don't implement HEAD. The
+	// client only gets the headers of the response.
+	HeadFallbackToGet bool
+
+	// ForceContentType, if set, replaces the Content-Type of requests with a
+	// body (or a Content-Type) on their way upstream, whatever the client
+	// sent, e.g. "application/json" for upstreams that insist on it.
+	ForceContentType string
+
+	// ForwardOnlyHeaders, if set, lists the only request headers (matched case
+	// insensitively) that are forwarded upstream, including those added by the
+	// Rewriter. Host and the headers describing the body are always kept.
+	ForwardOnlyHeaders []string
+
+	// CompressRequestBodyHosts lists the upstream hosts (with or without
+	// port) that accept compressed requests, typically behind slow links.
+	// Request bodies sent to them are gzipped on their way, setting
+	// Content-Encoding accordingly. Bodies that are already encoded are sent
+	// as is.
+	CompressRequestBodyHosts []string
+	// CompressRequestBody gzips request bodies sent to any upstream, for when
+	// they all accept them.
+	CompressRequestBody bool
+
+	// LocalAddr is the local address the default Dialer connects to upstreams
+	// from, e.g. to pick the source IP on multi-homed hosts.
+	LocalAddr net.Addr
+
+	// TLSHandshakeTimeout bounds the TLS handshake with HTTPS upstreams of the
+	// default transport. It defaults to 10 seconds.
+	TLSHandshakeTimeout time.Duration
+
+	// MinUpstreamTLSVersion is the oldest TLS version (e.g. tls.VersionTLS13)
+	// the default transport accepts from HTTPS upstreams. It defaults to TLS
+	// 1.2.
+	MinUpstreamTLSVersion uint16
+
+	// UpstreamRootCAs are the certificate authorities the default transport
+	// trusts to sign the certificates of HTTPS upstreams, instead of the
+	// system ones.
+	UpstreamRootCAs *x509.CertPool
+
+	// UpstreamTLSHeaders adds the TLS version and cipher suite negotiated with
+	// HTTPS upstreams to responses, in the X-Upstream-TLS-Version and
+	// X-Upstream-TLS-Cipher headers, for debugging. Either way, the state of
+	// the connection (certificate chain included) is available to OnResponse
+	// and the response stages as resp.TLS.
+	UpstreamTLSHeaders bool
+
+	// ClientCertSelector picks the client certificate the default transport
+	// presents to HTTPS upstreams that ask for one, by the host name of the
+	// upstream, for upstreams that require different certificates.
+	ClientCertSelector func(host string) (*tls.Certificate, error)
+
+	// DialRetries is how many more times the default transport dials an
+	// upstream when dialing fails, waiting DialBackoff (100ms by default)
+	// doubled after each attempt, with jitter, in between. Unlike Retries of
+	// a Route, this happens before anything is sent, so it applies to all
+	// requests.
+	DialRetries int
+	DialBackoff time.Duration
+
+	// LogUpstreamConns numbers the connections of the default transport and
+	// logs at debug level when each of them is dialed, reused, closed for
+	// being idle and closed by either end, to debug connection reuse.
+	LogUpstreamConns bool
+
+	// MaxRequestsPerConn, if set, makes the default transport close upstream
+	// connections once they've served this many requests, asking the upstream
+	// to close them along with the last one, so that long lived connections
+	// get recycled (e.g. to pick up DNS changes).
+	MaxRequestsPerConn int
+
+	// OnIdleClose is called with the remote address of upstream connections
+	// of the default transport that get closed for being idle for longer than
+	// IdleTimeout.
+	OnIdleClose func(addr string)
+
+	// AbsoluteFormUpstream sends requests upstream with the request target in
+	// absolute form ("GET http://host/path HTTP/1.1"), as expected by
+	// upstreams that are proxies themselves. The host is the one the client
+	// asked for, while the connection goes to the upstream.
+	AbsoluteFormUpstream bool
+
+	// ResponseStages are extra transformations of upstream responses. They
+	// run along with the built in ones, in ascending Order (see the
+	// ResponseStage* constants), after the response has been validated.
+	ResponseStages []ResponseStage
+
+	// ShouldForward gates forwarding, e.g. behind a feature flag or for canary
+	// routing. Requests for which it returns false are passed on to the next
+	// filter in the chain instead.
+	ShouldForward func(req *http.Request) bool
+
+	// MaxRedirectRepeats breaks redirect loops: once a client has been
+	// redirected to the same location more than this many times within
+	// RedirectLoopWindow (10 seconds by default), it gets a 508 instead.
+	MaxRedirectRepeats int
+	RedirectLoopWindow time.Duration
+
+	// OverrideServerHeader replaces the Server header of responses with
+	// ServerHeader, so that clients can't fingerprint the upstream. An empty
+	// ServerHeader removes it.
+	OverrideServerHeader bool
+	ServerHeader         string
+
+	// EchoRequestHeaders lists request headers (matched case insensitively)
+	// that are copied into the responses forwarded to the client, replacing
+	// any the upstream sent, e.g. X-Request-ID for debugging.
+	EchoRequestHeaders []string
+
+	// SecurityHeaders are added to responses that don't already have them,
+	// e.g. DefaultSecurityHeaders().
+	SecurityHeaders http.Header
+
+	// ClientIPStrategy determines the IP of the client, which is then sent
+	// upstream as X-Real-IP and used to track clients (e.g. for
+	// MaxRedirectRepeats). By default the remote address of the connection is
+	// used and X-Real-IP isn't set.
+	ClientIPStrategy ClientIPStrategy
+
+	// OnTimings is called after each successful round trip with the time it
+	// spent waiting for a connection and on the upstream. ServerTimingHeader
+	// also sends them to the client in a Server-Timing header.
+	OnTimings          func(req *http.Request, timings Timings)
+	ServerTimingHeader bool
+
+	// TraceSampleRate is the fraction of requests (between 0 and 1) whose
+	// headers, and those of their responses, are dumped at debug level, to
+	// trace a sample of the traffic without tracing all of it. Bodies aren't
+	// dumped so that they still stream.
+	TraceSampleRate float64
+
+	// RewriteStatus maps upstream response codes to the ones to send to the
+	// client instead (e.g. 418 to 400). The body is forwarded as is.
+	RewriteStatus map[int]int
+
+	// ReasonPhraseHeader, if set, is the response header in which custom
+	// reason phrases of upstream responses (e.g. "200 Alright") are sent to
+	// the client. net/http always writes the standard reason phrase in the
+	// status line, so the original one can't be preserved there.
+	ReasonPhraseHeader string
+
+	// BodyErrorMode is how to handle the upstream failing in the middle of
+	// the response body, and OnBodyCopyError is called with how much of the
+	// body had been forwarded by then.
+	BodyErrorMode   BodyErrorMode
+	OnBodyCopyError func(written int64, err error)
 }
 
 type forwarder struct {
 	*Options
+	pool      *upstreamPool
+	collapser *collapser
+	dns       *dnsCache
+	conns     connLimiter
+	successes uint64
+	connIDs   uint64
+
+	// Transport that never reuses connections, for the requests that mustn't
+	// share theirs
+	freshTransport http.RoundTripper
+
+	responseStages []ResponseStage
+	redirects      *redirectTracker
+	retries        *retryBudget
+	quotas         *quotaTracker
+
+	accessLog   chan *accessLogEntry
+	droppedLogs uint64
+
+	// Stops the background work, see Close
+	ctx        context.Context
+	stop       context.CancelFunc
+	background sync.WaitGroup
 }
 
 type RequestRewriter interface {
 	Rewrite(r *http.Request)
 }
 
+// New creates a filter that forwards requests upstream. The filter also
+// implements io.Closer, closing it stops the work it does in the background,
+// like the HealthCheck, and writes out the access log entries still queued by
+// AsyncAccessLog.
 func New(opts *Options) filters.Filter {
 	if opts.Rewriter == nil {
 		opts.Rewriter = &HeaderRewriter{
@@ -42,42 +574,271 @@ func New(opts *Options) filters.Filter {
 	}
 
 	if opts.Dialer == nil {
-		opts.Dialer = func(network, addr string) (net.Conn, error) {
-			return net.DialTimeout(network, addr, time.Second*30)
-		}
+		dialer := &net.Dialer{Timeout: time.Second * 30, LocalAddr: opts.LocalAddr}
+		opts.Dialer = dialer.Dial
 	}
+	if opts.RoundTripper == nil && opts.SharedTransport != nil {
+		opts.RoundTripper = opts.SharedTransport
+	}
+
+	f := &forwarder{Options: opts, collapser: newCollapser()}
+	f.ctx, f.stop = context.WithCancel(context.Background())
+	if opts.Resolver != nil || opts.DNSCacheTTL > 0 || opts.HappyEyeballs > 0 || opts.ServiceDomain != "" {
+		f.dns = newDNSCache(opts.Resolver, opts.DNSCacheTTL)
+	}
+
 	if opts.RoundTripper == nil {
-		dialerFunc := func(network, addr string) (net.Conn, error) {
-			conn, err := opts.Dialer(network, addr)
+		if opts.MaxUpstreamConns > 0 {
+			f.conns = newConnLimiter(opts.MaxUpstreamConns)
+		}
+		dialerFunc := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if f.conns != nil {
+				if err := f.conns.acquire(ctx, opts.UpstreamConnsWait); err != nil {
+					return nil, err
+				}
+			}
+			conn, err := f.dialWithRetries(ctx, network, addr)
 			if err != nil {
-				return nil, err
+				if f.conns != nil {
+					f.conns.release()
+				}
+				return nil, &DialError{addr, err}
+			}
+			if f.conns != nil {
+				conn = f.conns.track(conn)
+			}
+			if opts.SendProxyProtocol > 0 {
+				if err := writeProxyHeader(ctx, conn, opts.SendProxyProtocol); err != nil {
+					conn.Close()
+					return nil, err
+				}
 			}
 
-			idleConn := idletiming.Conn(conn, opts.IdleTimeout, nil)
+			var labeled *labeledConn
+			if opts.LogUpstreamConns {
+				labeled = f.labelConn(conn)
+				conn = labeled
+			}
+			var onIdle func()
+			if opts.OnIdleClose != nil {
+				remoteAddr := conn.RemoteAddr().String()
+				onIdle = func() {
+					opts.OnIdleClose(remoteAddr)
+				}
+			}
+			idleConn := idletiming.Conn(conn, opts.IdleTimeout, onIdle)
+			if labeled != nil {
+				labeled.idleConn = idleConn
+			}
+			if opts.MaxRequestsPerConn > 0 {
+				return &recycledConn{Conn: idleConn}, nil
+			}
 			return idleConn, err
 		}
 
+		idleConnTimeout := opts.IdleConnTimeout
+		if idleConnTimeout <= 0 {
+			idleConnTimeout = opts.IdleTimeout
+		}
+		tlsHandshakeTimeout := opts.TLSHandshakeTimeout
+		if tlsHandshakeTimeout <= 0 {
+			tlsHandshakeTimeout = 10 * time.Second
+		}
+		minTLSVersion := opts.MinUpstreamTLSVersion
+		if minTLSVersion == 0 {
+			minTLSVersion = tls.VersionTLS12
+		}
+		tlsConfig := &tls.Config{MinVersion: minTLSVersion, RootCAs: opts.UpstreamRootCAs}
+		if opts.ClientCertSelector != nil {
+			tlsConfig.GetClientCertificate = f.getClientCertificate
+		}
 		timeoutTransport := &http.Transport{
-			Dial:                dialerFunc,
-			TLSHandshakeTimeout: 10 * time.Second,
-			IdleConnTimeout:     opts.IdleTimeout, // remove idle keep-alive connections to avoid leaking memory
+			DialContext:         dialerFunc,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: tlsHandshakeTimeout,
+			IdleConnTimeout:     idleConnTimeout, // remove idle keep-alive connections to avoid leaking memory
+		}
+		if opts.UpstreamHTTP2 || opts.UpstreamH2C {
+			protocols := new(http.Protocols)
+			protocols.SetHTTP1(!opts.UpstreamH2C)
+			protocols.SetHTTP2(true)
+			protocols.SetUnencryptedHTTP2(opts.UpstreamH2C)
+			timeoutTransport.Protocols = protocols
 		}
 		opts.RoundTripper = timeoutTransport
+		if opts.ConnectionPolicy != nil || opts.SendProxyProtocol > 0 {
+			fresh := timeoutTransport.Clone()
+			fresh.DisableKeepAlives = true
+			f.freshTransport = fresh
+		}
+	}
+
+	if len(opts.Upstreams) > 0 || len(opts.WeightedUpstreams) > 0 {
+		f.pool = newUpstreamPool(opts.Upstreams, opts.WeightedUpstreams, opts.UpstreamCooldown)
+		if opts.ConsistentHash != nil {
+			f.pool.ring = newHashRing(f.pool.upstreams)
+		}
+		if opts.HealthCheck != nil {
+			f.pool.checkInterval = opts.HealthCheck.interval()
+			f.background.Add(1)
+			go func() {
+				defer f.background.Done()
+				f.checkHealth(opts.HealthCheck)
+			}()
+		}
+	}
+	f.responseStages = f.buildResponseStages()
+	if opts.MaxRedirectRepeats > 0 {
+		f.redirects = newRedirectTracker(opts.MaxRedirectRepeats, opts.RedirectLoopWindow, f.clientIP)
+	}
+	if opts.AsyncAccessLog > 0 {
+		f.accessLog = make(chan *accessLogEntry, opts.AsyncAccessLog)
+		f.background.Add(1)
+		go func() {
+			defer f.background.Done()
+			f.writeAccessLogs()
+		}()
 	}
+	if opts.BandwidthQuota != nil {
+		f.quotas = newQuotaTracker(opts.BandwidthQuota, f.clientIP)
+	}
+	if opts.RetryBudget > 0 {
+		f.retries = newRetryBudget(opts.RetryBudget)
+	}
+	return f
+}
 
-	return &forwarder{opts}
+// Close stops the background work of the forwarder and waits for it to be
+// over.
+func (f *forwarder) Close() error {
+	f.stop()
+	f.background.Wait()
+	return nil
 }
 
 func (f *forwarder) Apply(w http.ResponseWriter, req *http.Request, next filters.Next) error {
+	if f.ShouldForward != nil && !f.ShouldForward(req) {
+		return next()
+	}
+
 	op := ops.Begin("proxy_http")
 	defer op.End()
 
+	if f.Maintenance != nil && f.Maintenance.Load() {
+		log.Tracef("In maintenance, not forwarding request from %v to %v", req.RemoteAddr, req.Host)
+		if f.MaintenanceResponse != nil {
+			f.MaintenanceResponse(w)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "Down for maintenance")
+		}
+		return filters.Stop()
+	}
+
+	switch {
+	case req.Method == "TRACE" && f.BlockTrace:
+		return f.serveError(op, w, req, http.StatusMethodNotAllowed, "TRACE not allowed")
+	case req.Method == "OPTIONS" && f.LocalOptions != nil:
+		f.LocalOptions(w, req)
+		return filters.Stop()
+	}
+
+	if f.MaxURILength > 0 {
+		if n := len(requestURI(req)); n > f.MaxURILength {
+			return f.serveError(op, w, req, http.StatusRequestURITooLong, fmt.Sprintf("URI of %d bytes exceeds the limit of %d", n, f.MaxURILength))
+		}
+	}
+
+	if f.RejectPathTraversal && hasTraversal(req.URL.Path) {
+		return f.serveError(op, w, req, http.StatusBadRequest, "Path traversal not allowed")
+	}
+
+	if f.Authorize != nil {
+		if allowed, status, msg := f.Authorize(req); !allowed {
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			return f.serveError(op, w, req, status, msg)
+		}
+	}
+
+	var usage *quotaUsage
+	if f.quotas != nil {
+		usage = f.quotas.usageOf(req)
+		if wait, exceeded := f.quotas.exceeded(usage); exceeded {
+			setRetryAfter(w, wait)
+			return f.serveError(op, w, req, http.StatusTooManyRequests, "Bandwidth quota exceeded")
+		}
+	}
+
+	route := f.routeFor(req)
+	var u *url.URL
+	if route != nil {
+		u = route.URL
+	}
+	var up *upstream
+	if u == nil && f.pool != nil {
+		var retryAfter time.Duration
+		if f.ConsistentHash != nil {
+			up, retryAfter = f.pool.pickFor(f.ConsistentHash(req))
+		} else {
+			up, retryAfter = f.pool.pick()
+		}
+		if up == nil {
+			setRetryAfter(w, retryAfter)
+			return f.serveError(op, w, req, http.StatusServiceUnavailable, "All upstreams are unavailable")
+		}
+		u = up.url
+	}
+	if u == nil && req.Host == "" {
+		// Without an upstream, the Host is the only way to tell where to go
+		return f.serveError(op, w, req, http.StatusBadRequest, "Missing Host header")
+	}
+
 	// Create a copy of the request suitable for our needs
-	reqClone, err := f.cloneRequest(req, req.URL)
+	reqClone := f.cloneRequest(req, u)
+
+	if usage != nil && reqClone.Body != nil && reqClone.Body != http.NoBody {
+		reqClone.Body = &countingBody{reqClone.Body, usage}
+	}
+	var body *timeoutBody
+	if f.RequestBodyTimeout > 0 {
+		body = withBodyTimeout(w, reqClone, f.RequestBodyTimeout)
+	}
+	// Whatever reads the body ahead of the round trip goes through the above
+	stopCompressing := f.compressBody(w, reqClone)
+	err := f.frameBody(reqClone)
+	if err == nil && f.mayResend(route) {
+		err = bufferForReplay(reqClone)
+	}
 	if err != nil {
-		return op.FailIf(filters.Fail("Error forwarding from %v to %v: %v", req.RemoteAddr, req.Host, err))
+		stopCompressing()
+	}
+	switch {
+	case err == nil:
+	case body != nil && body.expired():
+		return f.serveError(op, w, req, http.StatusRequestTimeout, errRequestBodyTimeout)
+	case errors.Is(err, errRequestBodyTooLarge):
+		return f.serveError(op, w, req, http.StatusRequestEntityTooLarge, err)
+	case errors.Is(err, errRequestBodyIncomplete):
+		return f.serveError(op, w, req, http.StatusBadRequest, err)
+	default:
+		return op.FailIf(filters.Fail("Error reading request body from %v: %v", req.RemoteAddr, err))
 	}
 	f.Rewriter.Rewrite(reqClone)
+	reqClone = f.exposeUpstream(reqClone)
+	reqClone = f.modifyRequest(reqClone, req)
+	if f.MaxUpstreamHeaderBytes > 0 {
+		if n := headerBytes(reqClone.Header); n > f.MaxUpstreamHeaderBytes {
+			stopCompressing()
+			return f.serveError(op, w, req, http.StatusInternalServerError, fmt.Sprintf("Upstream request headers of %d bytes exceed the limit of %d", n, f.MaxUpstreamHeaderBytes))
+		}
+	}
+	if timeout := f.timeoutFor(req, route); timeout > 0 {
+		ctx, cancel := context.WithTimeout(reqClone.Context(), timeout)
+		defer cancel()
+		reqClone = reqClone.WithContext(ctx)
+	}
 
 	if log.IsTraceEnabled() {
 		reqStr, _ := httputil.DumpRequest(req, false)
@@ -86,45 +847,290 @@ func (f *forwarder) Apply(w http.ResponseWriter, req *http.Request, next filters
 		reqStr2, _ := httputil.DumpRequest(reqClone, false)
 		log.Tracef("Forwarder Middleware forwarding rewritten request:\n%s", reqStr2)
 	}
+	sampled := f.sampleTrace()
+	if sampled {
+		dumpSampledRequest(req, reqClone)
+	}
 
 	// Forward the request and get a response
+	if f.LogUpstreamConns {
+		reqClone = withConnReuseLog(reqClone)
+	}
+	var trace *timingTrace
+	if f.OnTimings != nil || f.ServerTimingHeader {
+		reqClone, trace = withTimingTrace(reqClone)
+	}
+	var upstreamTLS *tlsCapture
+	if f.UpstreamTLSHeaders || f.OnResponse != nil || len(f.ResponseStages) > 0 {
+		reqClone, upstreamTLS = withTLSCapture(reqClone)
+	}
+	if f.retries != nil {
+		f.retries.deposit()
+	}
 	start := time.Now().UTC()
-	response, err := f.RoundTripper.RoundTrip(reqClone)
+	response, err := f.roundTrip(reqClone)
+	if route != nil && route.Retries > 0 {
+		reqClone, response, err = f.retry(route, reqClone, response, err)
+	}
 	if err != nil {
-		return op.FailIf(filters.Fail("Error forwarding from %v to %v: %v", req.RemoteAddr, req.Host, err))
+		// The upstream won't get the rest of the body, and whatever reads it
+		// from here on shouldn't race with the compression
+		stopCompressing()
+	}
+	if err != nil && body != nil && body.expired() {
+		// The client's fault, not the upstream's
+		return f.serveError(op, w, req, http.StatusRequestTimeout, errRequestBodyTimeout)
+	}
+	if up != nil {
+		if f.OutlierDetection != nil {
+			f.OutlierDetection.record(up, err != nil || response.StatusCode >= 500)
+		} else if err != nil {
+			up.markDown(f.pool.cooldown)
+		} else {
+			up.markUp()
+		}
+	}
+	if err == nil && f.HeadFallbackToGet && reqClone.Method == "HEAD" && response.StatusCode == http.StatusMethodNotAllowed {
+		log.Debugf("Upstream doesn't allow HEAD for %v, retrying with GET", reqClone.URL)
+		response.Body.Close()
+		reqClone = reqClone.Clone(reqClone.Context())
+		reqClone.Method = "GET"
+		response, err = f.roundTrip(reqClone)
+	}
+	if err == nil && f.fallsBack(reqClone, response) {
+		log.Debugf("Upstream responded %d to %v, retrying against %v", response.StatusCode, reqClone.URL, f.FallbackUpstream)
+		response.Body.Close()
+		reqClone, err = f.fallbackRequest(reqClone)
+		if err == nil {
+			response, err = f.roundTrip(reqClone)
+		}
+	}
+	if err != nil {
+		if f.FallbackToNextOnError {
+			log.Debugf("Error forwarding from %v to %v, falling back to next filter: %v", req.RemoteAddr, req.Host, err)
+			return next()
+		}
+		return f.failRoundTrip(op, w, req, err)
+	}
+	f.logRoundTrip(reqClone, response, start)
+	var timings Timings
+	if trace != nil {
+		timings = trace.timings()
+		if f.OnTimings != nil {
+			f.OnTimings(req, timings)
+		}
 	}
-	log.Debugf("Round trip: %v, code: %v, duration: %v",
-		reqClone.URL, response.StatusCode, time.Now().UTC().Sub(start))
 
 	if log.IsTraceEnabled() {
-		respStr, _ := httputil.DumpResponse(response, true)
+		respStr, _ := httputil.DumpResponse(response, bodyAllowed(req.Method, response.StatusCode))
 		log.Tracef("Forward Middleware received response:\n%s", respStr)
 	}
+	if sampled {
+		dumpSampledResponse(req, response)
+	}
+
+	if f.FirstByteTimeout > 0 && response.Body != nil && bodyAllowed(req.Method, response.StatusCode) {
+		body, err := waitForFirstByte(response.Body, start.Add(f.FirstByteTimeout))
+		if err != nil {
+			response.Body.Close()
+			return f.serveError(op, w, req, http.StatusGatewayTimeout, err)
+		}
+		response.Body = body
+	}
+
+	if err := f.validateResponse(response); err != nil {
+		if response.Body != nil {
+			response.Body.Close()
+		}
+		return f.serveError(op, w, req, http.StatusBadGateway, err)
+	}
+	f.exposeUpstreamTLS(response, upstreamTLS)
+	f.modifyResponse(response)
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		return f.tunnelUpgrade(op, w, req, response, usage)
+	}
+
+	if f.redirects != nil && isRedirect(response.StatusCode) {
+		if location := response.Header.Get("Location"); location != "" && f.redirects.loops(req, location) {
+			if response.Body != nil {
+				response.Body.Close()
+			}
+			return f.serveError(op, w, req, http.StatusLoopDetected, fmt.Sprintf("Redirect loop detected at %v", location))
+		}
+	}
+
+	if f.BufferSmallResponses > 0 && response.Body != nil && response.ContentLength < 0 &&
+		len(response.Trailer) == 0 && bodyAllowed(req.Method, response.StatusCode) {
+		body, length, err := bufferSmallBody(response.Body, f.BufferSmallResponses)
+		if err != nil {
+			response.Body.Close()
+			return f.serveError(op, w, req, http.StatusBadGateway, err)
+		}
+		response.Body = body
+		if length >= 0 {
+			response.ContentLength = length
+			response.Header.Set(ContentLength, strconv.FormatInt(length, 10))
+		}
+	}
+
+	if f.NormalizeErrorBody != nil && response.Body != nil && bodyAllowed(req.Method, response.StatusCode) {
+		if err := f.normalizeErrorBody(response); err != nil {
+			response.Body.Close()
+			return f.serveError(op, w, req, http.StatusBadGateway, err)
+		}
+	}
+
+	if f.BodyErrorMode == BodyErrorBadGateway && response.Body != nil && bodyAllowed(req.Method, response.StatusCode) {
+		body, err := peekBody(response.Body)
+		if err != nil {
+			response.Body.Close()
+			return f.serveError(op, w, req, http.StatusBadGateway, err)
+		}
+		response.Body = body
+	}
 
 	// Forward the response to the origin
 	copyHeadersForForwarding(w.Header(), response.Header)
+	echoHeaders(w.Header(), req.Header, f.EchoRequestHeaders)
+	if !lengthAllowed(req.Method, response.StatusCode) {
+		// Like a 204 or a 2xx to a CONNECT, which must not carry a
+		// Content-Length
+		w.Header().Del(ContentLength)
+	}
+	if f.BodyErrorMode == BodyErrorTrailer && bodyAllowed(req.Method, response.StatusCode) {
+		// Trailers can only be sent along with chunked bodies
+		w.Header().Del(ContentLength)
+		w.Header().Add("Trailer", XBodyError)
+	}
+	if f.ServerTimingHeader {
+		w.Header().Add("Server-Timing", serverTiming(timings))
+	}
+	announceTrailers(w.Header(), response.Trailer)
 	w.WriteHeader(response.StatusCode)
 
 	// It became nil in a Co-Advisor test though the doc says it will never be nil
-	if response.Body != nil {
-		buf := buffers.Get()
-		defer buffers.Put(buf)
-		_, err = io.CopyBuffer(w, response.Body, buf)
+	if response.Body != nil && !bodyAllowed(req.Method, response.StatusCode) {
+		// Don't even try to copy a body that can't be there, it could stall
+		response.Body.Close()
+	} else if response.Body != nil {
+		var dst io.Writer = w
+		var buf []byte
+		if flusher, ok := w.(http.Flusher); ok && f.FlushInterval != 0 {
+			fw := &flushingWriter{dst: w, flusher: flusher, latency: f.FlushInterval}
+			defer fw.stop()
+			dst = fw
+			if f.StreamChunkSize > 0 {
+				buf = make([]byte, f.StreamChunkSize)
+			}
+		}
+		if buf == nil {
+			buf = buffers.Get()
+			defer buffers.Put(buf)
+		}
+		src := &upstreamBody{Reader: response.Body}
+		written, err := io.CopyBuffer(dst, src, buf)
 		if err != nil {
 			log.Debug(err)
 		}
+		if usage != nil {
+			usage.add(written)
+		}
+		if src.err != nil {
+			if f.OnBodyCopyError != nil {
+				f.OnBodyCopyError(written, src.err)
+			}
+			if f.BodyErrorMode == BodyErrorTrailer {
+				w.Header().Set(XBodyError, src.err.Error())
+			}
+		}
 
 		response.Body.Close()
+		// Trailers are only available once the body has been read
+		copyTrailers(w.Header(), response.Trailer)
 	}
 
 	return filters.Stop()
 }
 
-func (f *forwarder) cloneRequest(req *http.Request, u *url.URL) (*http.Request, error) {
+// setRetryAfter tells the client to come back after d, rounded up so that it
+// doesn't come back too early
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	secs := int64((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+}
+
+func (f *forwarder) roundTrip(req *http.Request) (*http.Response, error) {
+	req = f.withUpstreamHost(req)
+	if f.MaxRequestsPerConn > 0 {
+		req = f.withConnRecycling(req)
+	}
+	var headers *headerTimer
+	if f.HeaderReadTimeout > 0 {
+		req, headers = withHeaderReadTimeout(req, f.HeaderReadTimeout)
+	}
+	rt := f.RoundTripper
+	if req.Close && f.freshTransport != nil {
+		// Asking to close the connection afterwards doesn't keep the transport
+		// from sending the request on one that's already been used
+		rt = f.freshTransport
+	}
+	var resp *http.Response
+	var err error
+	if key, ok := f.collapseKey(req); ok {
+		resp, err = f.collapser.roundTrip(key, req, rt)
+	} else {
+		resp, err = rt.RoundTrip(req)
+	}
+	if headers != nil && headers.stop() && err != nil {
+		err = &TimeoutError{errHeaderReadTimeout}
+	}
+	return resp, err
+}
+
+func (f *forwarder) clientIP(req *http.Request) string {
+	if f.ClientIPStrategy != nil {
+		return f.ClientIPStrategy(req)
+	}
+	return DirectRemoteAddr(req)
+}
+
+func (f *forwarder) failRoundTrip(op ops.Op, w http.ResponseWriter, req *http.Request, err error) error {
+	f.drainBody(w, req)
+	err = classifyRoundTripError(err)
+	if errors.Is(err, errUpstreamConnsExhausted) {
+		return f.serveError(op, w, req, http.StatusServiceUnavailable, err)
+	}
+	var invalidResponse *InvalidResponseError
+	if errors.As(err, &invalidResponse) {
+		return f.serveError(op, w, req, http.StatusBadGateway, err)
+	}
+	if f.ErrorStatusMapper == nil {
+		return op.FailIf(filters.Fail("Error forwarding from %v to %v: %v", req.RemoteAddr, req.Host, err))
+	}
+	statusCode := f.ErrorStatusMapper(err)
+	log.Debugf("Error forwarding from %v to %v: %v", req.RemoteAddr, req.Host, err)
+	return f.serveError(op, w, req, statusCode, http.StatusText(statusCode))
+}
+
+func (f *forwarder) serveError(op ops.Op, w http.ResponseWriter, req *http.Request, statusCode int, reason interface{}) error {
+	log.Error(op.FailIf(fmt.Errorf("Respond error to request from %v to %v: %d %v", req.RemoteAddr, req.Host, statusCode, reason)))
+	w.WriteHeader(statusCode)
+	fmt.Fprintf(w, "%v", reason)
+	return filters.Stop()
+}
+
+func (f *forwarder) cloneRequest(req *http.Request, u *url.URL) *http.Request {
 	outReq := new(http.Request)
 	// Beware, this will make a shallow copy. We have to copy all maps
 	*outReq = *req
 
+	if method, found := f.MethodRewrite[req.Method]; found {
+		outReq.Method = method
+	}
+
 	outReq.Proto = "HTTP/1.1"
 	outReq.ProtoMajor = 1
 	outReq.ProtoMinor = 1
@@ -134,19 +1140,57 @@ func (f *forwarder) cloneRequest(req *http.Request, u *url.URL) (*http.Request,
 	// Request Header
 	outReq.Header = make(http.Header)
 	copyHeadersForForwarding(outReq.Header, req.Header)
-	// Ensure we have a HOST header (important for Go 1.6+ because http.Server
-	// strips the HOST header from the inbound request)
-	outReq.Header.Set("Host", req.Host)
-
+	f.RefererPolicy.apply(outReq.Header)
+	if isUpgrade(req.Header) {
+		// Connection and Upgrade are hop-by-hop, but the upstream can't switch
+		// protocols unless it's asked to
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header["Upgrade"] = append([]string(nil), req.Header["Upgrade"]...)
+	}
 	// Request URL
 	outReq.URL = cloneURL(req.URL)
-	// We know that is going to be HTTP always because HTTPS isn't forwarded.
-	// We need to hardcode it here because req.URL.Scheme can be undefined, since
-	// client request don't need to use absolute URIs
-	outReq.URL.Scheme = "http"
-	// We need to make sure the host is defined in the URL (not the actual URI)
-	outReq.URL.Host = req.Host
+	if u != nil {
+		// Routed to a specific upstream, which can be either HTTP or HTTPS
+		outReq.URL.Scheme = u.Scheme
+		outReq.URL.Host = u.Host
+		if f.UpstreamHostHeader {
+			outReq.Host = u.Host
+		}
+	} else {
+		// We know that is going to be HTTP always because HTTPS isn't forwarded.
+		// We need to hardcode it here because req.URL.Scheme can be undefined, since
+		// client request don't need to use absolute URIs
+		outReq.URL.Scheme = "http"
+		// We need to make sure the host is defined in the URL (not the actual URI)
+		outReq.URL.Host = req.Host
+	}
 	outReq.URL.RawQuery = req.URL.RawQuery
+	if f.CleanPath {
+		if cleaned := cleanPath(outReq.URL.Path); cleaned != outReq.URL.Path {
+			log.Tracef("Cleaning path from %v to %v", outReq.URL.Path, cleaned)
+			outReq.URL.Path = cleaned
+			outReq.URL.RawPath = ""
+		}
+	}
+	if rw := f.RewritePath; rw != nil {
+		rw.rewrite(outReq.URL)
+	}
+
+	if f.AbsoluteFormUpstream {
+		// URL.RequestURI() renders opaque URLs starting with // as
+		// scheme://opaque, which the transport then uses as the request target
+		outReq.URL.Opaque = "//" + outReq.Host + outReq.URL.EscapedPath()
+	}
+
+	// Ensure we have a HOST header (important for Go 1.6+ because http.Server
+	// strips the HOST header from the inbound request). The transport actually
+	// takes it from outReq.Host, which is also what ends up as :authority when
+	// talking HTTP/2, so keep both in sync.
+	outReq.Header.Set("Host", outReq.Host)
+
+	if f.ForceContentType != "" && (outReq.Header.Get("Content-Type") != "" || (outReq.Body != nil && outReq.Body != http.NoBody)) {
+		outReq.Header.Set("Content-Type", f.ForceContentType)
+	}
 
 	userAgent := req.UserAgent()
 	if userAgent == "" {
@@ -155,36 +1199,25 @@ func (f *forwarder) cloneRequest(req *http.Request, u *url.URL) (*http.Request,
 		outReq.Header.Set("User-Agent", userAgent)
 	}
 
-	/*
-		// Trailer support
-		// We are forced to do this because Go's server won't allow us to read the trailers otherwise
-		_, err := httputil.DumpRequestOut(req, true)
-		if err != nil {
-		  log.Errorf("Error: %v", err)
-		  return outReq, err
-		}
-
-		rcloser := ioutil.NopCloser(req.Body)
-		outReq.Body = rcloser
-
-		chunkedTransfer := false
-		for _, enc := range req.TransferEncoding {
-		  if enc == "chunked" {
-		    chunkedTransfer = true
-		    break
-		  }
-		}
+	// Transfer-Encoding overrides Content-Length (section 3.3.3 of RFC 7230).
+	// Never let a stale Content-Length through along with a chunked body, the
+	// upstream could take it as the end of the request and the rest of the
+	// body as a new (smuggled) one.
+	if isChunked(req.TransferEncoding) {
+		outReq.Header.Del(ContentLength)
+		outReq.ContentLength = -1
+	}
 
-		// Append Trailer
-		if chunkedTransfer && len(req.Trailer) > 0 {
-		  outReq.Trailer = http.Header{}
-		  for k, vv := range req.Trailer {
-		    for _, v := range vv {
-		      outReq.Trailer.Add(k, v)
-		    }
-		  }
-		}
-	*/
+	// Trailer support. The server only fills in the values of req.Trailer once
+	// the body has been fully read, so share the map instead of copying it and
+	// the transport will send them after the body.
+	outReq.Trailer = nil
+	if !f.DisableRequestTrailers && isChunked(req.TransferEncoding) && len(req.Trailer) > 0 {
+		outReq.Trailer = req.Trailer
+	}
 
-	return outReq, nil
+	if f.maxDrainBytes() > 0 && outReq.Body != nil && outReq.Body != http.NoBody {
+		outReq.Body = keepOpenBody{outReq.Body}
+	}
+	return outReq
 }
@@ -1,11 +1,21 @@
 package forward
 
 import (
+	"bufio"
 	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/getlantern/http-proxy/filters"
+	"github.com/getlantern/http-proxy/utils"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -46,3 +56,334 @@ func TestCloneRequest(t *testing.T) {
 	req, _ := http.NewRequest("GET", url, nil)
 	fwd.ServeHTTP(emptyRW{}, req)
 }
+
+func TestConflictingContentLengthAndTransferEncoding(t *testing.T) {
+	type received struct {
+		header http.Header
+		te     []string
+		body   string
+	}
+	requests := make(chan received, 2)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- received{req.Header, req.TransferEncoding, string(body)}
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	proxy := httptest.NewServer(filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Upstreams:   []*url.URL{originURL},
+	})))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST / HTTP/1.1\r\nHost: site.com\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"d\r\nsmuggled data\r\n0\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+
+	r := <-requests
+	assert.Equal(t, "smuggled data", r.body, "the whole chunked body should be sent as one request")
+	assert.Equal(t, []string{"chunked"}, r.te)
+	assert.Empty(t, r.header.Get("Content-Length"))
+	assert.Len(t, requests, 0, "no request should have been smuggled")
+
+	// Requests that didn't come through the server
+	rt := mockRT{func(r *http.Request) (*http.Response, error) {
+		assert.Empty(t, r.Header.Get("Content-Length"))
+		assert.EqualValues(t, -1, r.ContentLength)
+		return nil, errors.New("intentionally fail")
+	}}
+	fwd := filters.Join(New(&Options{RoundTripper: rt}))
+	req, _ := http.NewRequest("POST", origin.URL, strings.NewReader("smuggled data"))
+	req.ContentLength = 4
+	req.Header.Set("Content-Length", "4")
+	req.TransferEncoding = []string{"chunked"}
+	fwd.ServeHTTP(emptyRW{}, req)
+}
+
+func TestSharedTransport(t *testing.T) {
+	var newConns int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	origin.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	fwd1 := filters.Join(New(&Options{SharedTransport: transport}))
+	fwd2 := filters.Join(New(&Options{SharedTransport: transport}))
+
+	for _, fwd := range []filters.Chain{fwd1, fwd2, fwd1, fwd2} {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, "hello", w.Body.String())
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&newConns), "forwarders should have reused the same idle connection")
+}
+
+func TestAuthorize(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Authorize: func(req *http.Request) (bool, int, string) {
+			if req.Header.Get("X-Role") != "admin" {
+				return false, http.StatusUnauthorized, "admins only"
+			}
+			return true, 0, ""
+		},
+	}))
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "admins only", w.Body.String())
+	assert.EqualValues(t, 0, atomic.LoadInt32(&hits), "denied request should not reach the origin")
+
+	req, _ = http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("X-Role", "admin")
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+}
+
+func TestFallbackToNextOnError(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	// Close right away so that dialing it fails
+	origin.Close()
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("cached"))
+	})
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:           30 * time.Second,
+		FallbackToNextOnError: true,
+	}), filters.Adapt(fallback))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "cached", w.Body.String())
+
+	fwd = filters.Join(New(&Options{IdleTimeout: 30 * time.Second}), filters.Adapt(fallback))
+	req, _ = http.NewRequest("GET", origin.URL, nil)
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadGateway, w.Code, "should fail without the fallback enabled")
+}
+
+func TestShouldForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("new backend"))
+	}))
+	defer origin.Close()
+
+	legacy := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("legacy"))
+	})
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		ShouldForward: func(req *http.Request) bool {
+			return req.Header.Get("X-Canary") == "true"
+		},
+	}), filters.Adapt(legacy))
+
+	for canary, expected := range map[string]string{"true": "new backend", "": "legacy"} {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		req.Header.Set("X-Canary", canary)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, expected, w.Body.String())
+	}
+}
+
+func TestMaxURILength(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:  30 * time.Second,
+		MaxURILength: 100,
+	}))
+
+	req, _ := http.NewRequest("GET", origin.URL+"/"+strings.Repeat("a", 100), nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestURITooLong, w.Code)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&hits), "should not contact the origin")
+
+	req, _ = http.NewRequest("GET", origin.URL+"/short?q=1", nil)
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&hits))
+}
+
+func TestMissingHost(t *testing.T) {
+	var dials int32
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial(network, addr)
+		},
+	}))
+
+	req, _ := http.NewRequest("GET", "/path", nil)
+	assert.Empty(t, req.Host)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&dials), "should not dial anything")
+}
+
+type overloadedError struct{}
+
+func (e overloadedError) Error() string {
+	return "upstream overloaded"
+}
+
+func TestErrorStatusMapper(t *testing.T) {
+	var rtErr error
+	rt := mockRT{func(r *http.Request) (*http.Response, error) {
+		return nil, rtErr
+	}}
+	fwd := filters.Join(New(&Options{
+		RoundTripper: rt,
+		ErrorStatusMapper: func(err error) int {
+			if _, ok := err.(overloadedError); ok {
+				return http.StatusServiceUnavailable
+			}
+			return utils.StatusForError(err)
+		},
+	}))
+
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{overloadedError{}, http.StatusServiceUnavailable},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, http.StatusBadGateway},
+		{io.EOF, http.StatusBadGateway},
+		{errors.New("something else"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		rtErr = test.err
+		req, _ := http.NewRequest("GET", "http://site.com/", nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, test.expected, w.Code, "wrong status for %v", test.err)
+	}
+}
+
+func TestTraceAndOptions(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(req.Method))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		BlockTrace:  true,
+		LocalOptions: func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Allow", "GET, POST, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+		},
+	}))
+
+	req, _ := http.NewRequest("TRACE", origin.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	req, _ = http.NewRequest("OPTIONS", origin.URL, nil)
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "GET, POST, OPTIONS", w.Header().Get("Allow"))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&hits), "origin should not have been contacted")
+
+	// Both are forwarded by default
+	fwd = filters.Join(New(&Options{IdleTimeout: 30 * time.Second}))
+	for _, method := range []string{"TRACE", "OPTIONS"} {
+		req, _ = http.NewRequest(method, origin.URL, nil)
+		w = httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, method, w.Body.String())
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	var maintenance atomic.Bool
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Maintenance: &maintenance,
+		MaintenanceResponse: func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("<h1>Back soon</h1>"))
+		},
+	}))
+
+	for i := 0; i < 9; i++ {
+		// Flip into maintenance for the middle third of the requests
+		maintenance.Store(i >= 3 && i < 6)
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		if i >= 3 && i < 6 {
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code, "request %d", i)
+			assert.Equal(t, "<h1>Back soon</h1>", w.Body.String())
+			assert.Equal(t, "60", w.Header().Get("Retry-After"))
+		} else {
+			assert.Equal(t, http.StatusOK, w.Code, "request %d", i)
+			assert.Equal(t, "hello", w.Body.String())
+		}
+	}
+	assert.EqualValues(t, 6, atomic.LoadInt32(&hits), "requests in maintenance should not be forwarded")
+
+	// Without a custom response
+	maintenance.Store(true)
+	fwd = filters.Join(New(&Options{IdleTimeout: 30 * time.Second, Maintenance: &maintenance}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.EqualValues(t, 6, atomic.LoadInt32(&hits))
+}
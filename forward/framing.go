@@ -0,0 +1,94 @@
+package forward
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Framing is the way a request body is delimited on the wire
+type Framing int
+
+const (
+	// FramingAuto keeps the framing of the original request: chunked for
+	// streaming bodies and Content-Length for bodies of known length.
+	FramingAuto Framing = iota
+	// FramingChunked always sends bodies with chunked transfer encoding.
+	FramingChunked
+	// FramingContentLength always sends bodies with a Content-Length,
+	// buffering bodies of unknown length in memory, up to
+	// MaxRequestBodyBytes. Request trailers can't be sent this way, so they're
+	// dropped.
+	FramingContentLength
+)
+
+const defaultMaxRequestBodyBytes = 10 << 20
+
+var (
+	errRequestBodyTooLarge   = errors.New("Request body too large")
+	errRequestBodyIncomplete = errors.New("Request body shorter than its Content-Length")
+)
+
+// bufferBody reads the whole body into memory, up to MaxRequestBodyBytes,
+// and sends it with a Content-Length
+func (f *forwarder) bufferBody(outReq *http.Request) error {
+	max := f.MaxRequestBodyBytes
+	if max <= 0 {
+		max = defaultMaxRequestBodyBytes
+	}
+	if outReq.ContentLength > max {
+		return errRequestBodyTooLarge
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(outReq.Body, max+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > max {
+		return errRequestBodyTooLarge
+	}
+	if outReq.ContentLength > 0 && int64(len(body)) != outReq.ContentLength {
+		return errRequestBodyIncomplete
+	}
+	outReq.Body.Close()
+	setBody(outReq, body)
+	outReq.Header.Del("Transfer-Encoding")
+	outReq.TransferEncoding = nil
+	outReq.Trailer = nil
+	return nil
+}
+
+// setBody replaces the body of the request with one in memory, which can be
+// read again through GetBody
+func setBody(outReq *http.Request, body []byte) {
+	outReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	outReq.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	outReq.ContentLength = int64(len(body))
+}
+
+// frameBody applies UpstreamFraming to the outbound request
+func (f *forwarder) frameBody(outReq *http.Request) error {
+	if outReq.Body == nil || outReq.Body == http.NoBody || outReq.ContentLength == 0 {
+		return nil
+	}
+
+	if f.BufferRequestBody {
+		return f.bufferBody(outReq)
+	}
+
+	switch f.UpstreamFraming {
+	case FramingChunked:
+		outReq.ContentLength = -1
+		outReq.TransferEncoding = []string{"chunked"}
+	case FramingContentLength:
+		if outReq.ContentLength > 0 {
+			outReq.TransferEncoding = nil
+			return nil
+		}
+		return f.bufferBody(outReq)
+	}
+	return nil
+}
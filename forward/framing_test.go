@@ -0,0 +1,146 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamFraming(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(w, "%v %d %s", req.TransferEncoding, req.ContentLength, body)
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		framing   Framing
+		streaming bool
+		expected  string
+	}{
+		{FramingAuto, true, "[chunked] -1 payload"},
+		{FramingAuto, false, "[] 7 payload"},
+		{FramingChunked, false, "[chunked] -1 payload"},
+		{FramingContentLength, true, "[] 7 payload"},
+	}
+	for _, test := range tests {
+		client, closeProxy := proxiedClient(New(&Options{
+			IdleTimeout:     30 * time.Second,
+			UpstreamFraming: test.framing,
+		}))
+
+		var req *http.Request
+		if test.streaming {
+			// Hide the length so that the client uses chunked encoding
+			req, _ = http.NewRequest("POST", origin.URL, ioutil.NopCloser(strings.NewReader("payload")))
+		} else {
+			req, _ = http.NewRequest("POST", origin.URL, strings.NewReader("payload"))
+		}
+		resp, err := client.Do(req)
+		if assert.NoError(t, err) {
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, test.expected, string(b), "framing %d, streaming %v", test.framing, test.streaming)
+		}
+		closeProxy()
+	}
+}
+
+func TestBufferRequestBody(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(w, "%v %d %s", req.TransferEncoding, req.ContentLength, body)
+	}))
+	defer origin.Close()
+
+	client, closeProxy := proxiedClient(New(&Options{
+		IdleTimeout:         30 * time.Second,
+		BufferRequestBody:   true,
+		MaxRequestBodyBytes: 10,
+	}))
+	defer closeProxy()
+
+	tests := []struct {
+		body           string
+		expectedStatus int
+		expected       string
+	}{
+		{"payload", http.StatusOK, "[] 7 payload"},
+		{"payload too large", http.StatusRequestEntityTooLarge, "Request body too large"},
+	}
+	for _, test := range tests {
+		// Hide the length so that the client uses chunked encoding
+		req, _ := http.NewRequest("POST", origin.URL, ioutil.NopCloser(strings.NewReader(test.body)))
+		resp, err := client.Do(req)
+		if assert.NoError(t, err) {
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, test.expectedStatus, resp.StatusCode)
+			assert.Equal(t, test.expected, string(b))
+		}
+	}
+}
+
+func TestBufferRequestBodyTimeout(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer origin.Close()
+
+	client, closeProxy := proxiedClient(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		BufferRequestBody:  true,
+		RequestBodyTimeout: 100 * time.Millisecond,
+	}))
+	defer closeProxy()
+
+	body, stall := io.Pipe()
+	defer stall.Close()
+	go stall.Write([]byte("part of the body"))
+	req, _ := http.NewRequest("POST", origin.URL, body)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	assert.True(t, time.Now().Sub(start) < time.Second, "buffering should be bound by the body timeout")
+	assert.EqualValues(t, 0, atomic.LoadInt32(&hits), "partial body should not be forwarded")
+}
+
+func TestFramingContentLengthLimit(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(w, "%d %s", req.ContentLength, body)
+	}))
+	defer origin.Close()
+
+	client, closeProxy := proxiedClient(New(&Options{
+		IdleTimeout:         30 * time.Second,
+		UpstreamFraming:     FramingContentLength,
+		MaxRequestBodyBytes: 10,
+	}))
+	defer closeProxy()
+
+	for body, expectedStatus := range map[string]int{
+		"payload":           http.StatusOK,
+		"payload too large": http.StatusRequestEntityTooLarge,
+	} {
+		req, _ := http.NewRequest("POST", origin.URL, ioutil.NopCloser(strings.NewReader(body)))
+		resp, err := client.Do(req)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, expectedStatus, resp.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func h2cProtocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return protocols
+}
+
+// grpcFrame encodes msg as a length-prefixed, uncompressed gRPC message
+func grpcFrame(msg string) []byte {
+	frame := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	copy(frame[5:], msg)
+	return frame
+}
+
+func TestGRPCUnary(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 || req.Header.Get("Te") != "trailers" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Write(grpcFrame("hello " + string(body[5:])))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "OK")
+	}))
+	origin.Config.Protocols = h2cProtocols()
+	origin.Start()
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	proxy := httptest.NewUnstartedServer(filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Upstreams:   []*url.URL{originURL},
+		UpstreamH2C: true,
+	})))
+	proxy.Config.Protocols = h2cProtocols()
+	proxy.Start()
+	defer proxy.Close()
+
+	transport := &http.Transport{Protocols: h2cProtocols()}
+	defer transport.CloseIdleConnections()
+	req, _ := http.NewRequest("POST", proxy.URL+"/helloworld.Greeter/SayHello", bytes.NewReader(grpcFrame("world")))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := transport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, grpcFrame("hello world"), body)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "OK", resp.Trailer.Get("Grpc-Message"))
+}
@@ -0,0 +1,62 @@
+package forward
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is how many points each unit of weight gets on the ring. More
+// points spread the keys more evenly across upstreams.
+const virtualNodes = 100
+
+// hashRing maps keys to upstreams with consistent hashing, so that adding or
+// removing an upstream only remaps the keys that belong to it.
+type hashRing struct {
+	hashes    []uint32
+	upstreams []*upstream
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+func newHashRing(upstreams []*upstream) *hashRing {
+	var points []ringPoint
+	for _, u := range upstreams {
+		for i := 0; i < virtualNodes*u.weight; i++ {
+			hash := crc32.ChecksumIEEE([]byte(u.url.String() + "#" + strconv.Itoa(i)))
+			points = append(points, ringPoint{hash, u})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	r := &hashRing{}
+	for _, point := range points {
+		r.hashes = append(r.hashes, point.hash)
+		r.upstreams = append(r.upstreams, point.upstream)
+	}
+	return r
+}
+
+// lookup returns the first upstream on the ring at or after the key for which
+// usable returns true, or nil if there's none.
+func (r *hashRing) lookup(key string, usable func(*upstream) bool) *upstream {
+	if len(r.hashes) == 0 {
+		return nil
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	for i := 0; i < len(r.hashes); i++ {
+		u := r.upstreams[(start+i)%len(r.hashes)]
+		if usable(u) {
+			return u
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestHashRingRemapping(t *testing.T) {
+	var upstreams []*upstream
+	for i := 0; i < 3; i++ {
+		u, _ := url.Parse("http://backend" + strconv.Itoa(i) + ":8080")
+		upstreams = append(upstreams, &upstream{url: u, weight: 1})
+	}
+	all := newHashRing(upstreams)
+	withoutLast := newHashRing(upstreams[:2])
+	usable := func(*upstream) bool { return true }
+
+	counts := make(map[*upstream]int)
+	for i := 0; i < 3000; i++ {
+		key := "/object/" + strconv.Itoa(i)
+		before := all.lookup(key, usable)
+		counts[before]++
+		after := withoutLast.lookup(key, usable)
+		if before != upstreams[2] {
+			assert.Equal(t, before, after, "keys of the remaining upstreams shouldn't move")
+		}
+		assert.Equal(t, after, withoutLast.lookup(key, usable), "should consistently map the same key")
+	}
+	for _, u := range upstreams {
+		assert.InDelta(t, 1000, counts[u], 300, "keys should be spread across upstreams")
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	a, aURL := namedOrigin("a")
+	defer a.Close()
+	b, bURL := namedOrigin("b")
+	defer b.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Upstreams:   []*url.URL{aURL, bURL},
+		ConsistentHash: func(req *http.Request) string {
+			return req.URL.Path
+		},
+	}))
+
+	served := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		path := "/object/" + strconv.Itoa(i)
+		var first string
+		for j := 0; j < 3; j++ {
+			req, _ := http.NewRequest("GET", "http://site.com"+path, nil)
+			w := httptest.NewRecorder()
+			fwd.ServeHTTP(w, req)
+			if j == 0 {
+				first = w.Body.String()
+			}
+			assert.Equal(t, first, w.Body.String(), "%v should always go to the same upstream", path)
+		}
+		served[first] = true
+	}
+	assert.Len(t, served, 2, "both upstreams should get some keys")
+}
@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHealthCheckInterval = 10 * time.Second
+
+// HealthCheck configures active health checking of upstreams: every Interval
+// (10 seconds by default), each of them gets a GET for Path. An upstream is
+// taken out of rotation after failing UnhealthyThreshold checks in a row, by
+// erroring or not responding with a 2xx, and put back after passing
+// HealthyThreshold in a row. Both thresholds default to 1.
+type HealthCheck struct {
+	Path               string
+	Interval           time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+func (hc *HealthCheck) interval() time.Duration {
+	if hc.Interval <= 0 {
+		return defaultHealthCheckInterval
+	}
+	return hc.Interval
+}
+
+// checkHealth checks the health of the upstreams of the pool until the
+// forwarder is closed
+func (f *forwarder) checkHealth(hc *HealthCheck) {
+	interval := hc.interval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-f.ctx.Done():
+			return
+		}
+		var wg sync.WaitGroup
+		for _, u := range f.pool.upstreams {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				hc.record(u, f.probe(u, hc.Path, interval))
+			}(u)
+		}
+		wg.Wait()
+	}
+}
+
+// probe tells whether the upstream responds successfully to a GET for path
+// within the timeout
+func (f *forwarder) probe(u *upstream, path string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(f.ctx, timeout)
+	defer cancel()
+	target := u.url.ResolveReference(&url.URL{Path: path})
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		log.Errorf("Unable to build health check request for %v: %v", u.url, err)
+		return false
+	}
+	resp, err := f.RoundTripper.RoundTrip(f.withUpstreamHost(req))
+	if err != nil {
+		log.Debugf("Health check of %v failed: %v", u.url, err)
+		return false
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Debugf("Health check of %v failed with %d", u.url, resp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// record counts the outcome of a check, marking the upstream as healthy or
+// unhealthy once it reaches the threshold
+func (hc *HealthCheck) record(u *upstream, healthy bool) {
+	if healthy {
+		u.failures = 0
+		u.passes++
+		if u.passes >= atLeastOne(hc.HealthyThreshold) && atomic.CompareAndSwapInt32(&u.unhealthy, 1, 0) {
+			log.Debugf("Upstream %v is healthy again", u.url)
+		}
+		return
+	}
+	u.passes = 0
+	u.failures++
+	if u.failures >= atLeastOne(hc.UnhealthyThreshold) && atomic.CompareAndSwapInt32(&u.unhealthy, 0, 1) {
+		log.Errorf("Upstream %v is unhealthy, taking it out of rotation", u.url)
+	}
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var healthy, checks int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/healthz" {
+			atomic.AddInt32(&checks, 1)
+		}
+		if req.URL.Path == "/healthz" && atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("flaky"))
+	}))
+	defer flaky.Close()
+	flakyURL, _ := url.Parse(flaky.URL)
+	steady, steadyURL := namedOrigin("steady")
+	defer steady.Close()
+
+	forwarder := New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Upstreams:   []*url.URL{flakyURL, steadyURL},
+		HealthCheck: &HealthCheck{
+			Path:               "/healthz",
+			Interval:           20 * time.Millisecond,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+	})
+	defer forwarder.(io.Closer).Close()
+	fwd := filters.Join(forwarder)
+	served := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			w := httptest.NewRecorder()
+			fwd.ServeHTTP(w, req)
+			b, _ := ioutil.ReadAll(w.Body)
+			counts[string(b)]++
+		}
+		return counts
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, map[string]int{"steady": 4}, served(), "unhealthy upstream should be out of rotation")
+
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, map[string]int{"flaky": 2, "steady": 2}, served(), "healthy upstream should be back in rotation")
+
+	// Closing the forwarder stops the checks
+	forwarder.(io.Closer).Close()
+	before := atomic.LoadInt32(&checks)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, before, atomic.LoadInt32(&checks), "should have stopped checking")
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	hc := &HealthCheck{HealthyThreshold: 2, UnhealthyThreshold: 3}
+	u := &upstream{}
+	now := time.Now()
+	for _, check := range []struct {
+		healthy bool
+		up      bool
+	}{
+		{false, true},
+		{false, true},
+		{true, true}, // Resets the failures
+		{false, true},
+		{false, true},
+		{false, false},
+		{true, false},
+		{false, false}, // Resets the passes
+		{true, false},
+		{true, true},
+	} {
+		hc.record(u, check.healthy)
+		assert.Equal(t, check.up, u.isUp(now))
+	}
+}
@@ -0,0 +1,44 @@
+//go:build http3
+// +build http3
+
+// Package http3 provides an http.RoundTripper that forwards requests to
+// upstreams over HTTP/3 (QUIC). It lives in its own package, behind the http3
+// build tag, so that the forward package doesn't depend on quic-go. Plug it
+// into the forwarder with forward.Options.RoundTripper.
+package http3
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	quichttp3 "github.com/quic-go/quic-go/http3"
+)
+
+type roundTripper struct {
+	transport *quichttp3.Transport
+}
+
+// NewRoundTripper constructs a RoundTripper that sends requests over HTTP/3
+// using the given TLS configuration (which may be nil).
+func NewRoundTripper(tlsConfig *tls.Config) http.RoundTripper {
+	return &roundTripper{&quichttp3.Transport{TLSClientConfig: tlsConfig}}
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		// HTTP/3 always runs over TLS, but the forwarder defaults to http for
+		// requests that weren't routed to a specific upstream
+		outReq := new(http.Request)
+		*outReq = *req
+		u := *req.URL
+		u.Scheme = "https"
+		outReq.URL = &u
+		req = outReq
+	}
+	return rt.transport.RoundTrip(req)
+}
+
+// Close closes the underlying QUIC connections.
+func (rt *roundTripper) Close() error {
+	return rt.transport.Close()
+}
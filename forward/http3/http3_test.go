@@ -0,0 +1,75 @@
+//go:build http3
+// +build http3
+
+package http3
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	quichttp3 "github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+	"github.com/getlantern/http-proxy/forward"
+)
+
+func TestForwardOverHTTP3(t *testing.T) {
+	cert, err := selfSignedCert()
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	origin := &quichttp3.Server{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(req.Proto))
+		}),
+	}
+	go origin.Serve(conn)
+	defer origin.Close()
+
+	rt := NewRoundTripper(&tls.Config{InsecureSkipVerify: true})
+	defer rt.(*roundTripper).Close()
+	fwd := filters.Join(forward.New(&forward.Options{
+		IdleTimeout:  30 * time.Second,
+		RoundTripper: rt,
+	}))
+
+	req, _ := http.NewRequest("GET", "http://"+conn.LocalAddr().String()+"/", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "HTTP/3.0", w.Body.String())
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,53 @@
+package forward
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const maxNormalizedErrorBytes = 64 << 10
+
+var defaultNormalizeErrorTypes = []string{"application/json"}
+
+// normalizeErrorBody passes the body of error responses through
+// NormalizeErrorBody
+func (f *forwarder) normalizeErrorBody(resp *http.Response) error {
+	if resp.StatusCode < 400 || resp.ContentLength > maxNormalizedErrorBytes {
+		return nil
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	types := f.NormalizeErrorTypes
+	if len(types) == 0 {
+		types = defaultNormalizeErrorTypes
+	}
+	if !containsFold(mediaType, types) {
+		return nil
+	}
+
+	body, length, err := bufferSmallBody(resp.Body, maxNormalizedErrorBytes)
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	if length < 0 {
+		// Too large
+		return nil
+	}
+	original, _ := ioutil.ReadAll(body)
+	body.Close()
+	normalized := f.NormalizeErrorBody(resp.StatusCode, original)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(normalized))
+	resp.ContentLength = int64(len(normalized))
+	resp.Header.Set(ContentLength, strconv.Itoa(len(normalized)))
+	resp.Header.Del("Transfer-Encoding")
+	return nil
+}
@@ -0,0 +1,66 @@
+package forward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestNormalizeErrorBody(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"msg":"database down"}`))
+		case "/text":
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("database down"))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"ok":true}`))
+		}
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		NormalizeErrorBody: func(status int, body []byte) []byte {
+			normalized, _ := json.Marshal(map[string]interface{}{
+				"error": map[string]interface{}{
+					"status": status,
+					"detail": json.RawMessage(body),
+				},
+			})
+			return normalized
+		},
+	}))
+
+	tests := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{"/json", http.StatusInternalServerError, `{"error":{"detail":{"msg":"database down"},"status":500}}`},
+		{"/text", http.StatusInternalServerError, "database down"},
+		{"/ok", http.StatusOK, `{"ok":true}`},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", origin.URL+test.path, nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, test.status, w.Code, test.path)
+		assert.Equal(t, test.expected, w.Body.String(), test.path)
+		if test.path == "/json" {
+			assert.Equal(t, strconv.Itoa(len(test.expected)), w.Header().Get("Content-Length"), "%v should have the length of the normalized body", test.path)
+		}
+	}
+}
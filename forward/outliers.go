@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultOutlierWindow       = 10 * time.Second
+	defaultOutlierMinRequests  = 5
+	defaultOutlierBaseEjection = 30 * time.Second
+	defaultOutlierMaxEjection  = 5 * time.Minute
+)
+
+// OutlierDetection ejects upstreams from rotation when the fraction of their
+// requests that fail (with an error or a 5xx response) within a Window (10
+// seconds by default) exceeds ErrorRate, provided they got at least
+// MinRequests (5 by default) requests in it. The first ejection lasts
+// BaseEjection (30 seconds by default), and each one that follows without a
+// good window in between lasts twice as long as the previous one, up to
+// MaxEjection (5 minutes by default).
+type OutlierDetection struct {
+	ErrorRate    float64
+	Window       time.Duration
+	MinRequests  int
+	BaseEjection time.Duration
+	MaxEjection  time.Duration
+}
+
+// outlierStats are the outcomes of the requests to an upstream in the current
+// window
+type outlierStats struct {
+	mx          sync.Mutex
+	windowStart time.Time
+	requests    int
+	errors      int
+	// Ejections in a row
+	ejections int
+}
+
+// record counts the outcome of a request to the upstream, ejecting it if it
+// turns out to be an outlier
+func (od *OutlierDetection) record(u *upstream, failed bool) {
+	window := od.Window
+	if window <= 0 {
+		window = defaultOutlierWindow
+	}
+	minRequests := od.MinRequests
+	if minRequests <= 0 {
+		minRequests = defaultOutlierMinRequests
+	}
+
+	now := time.Now()
+	stats := &u.outliers
+	stats.mx.Lock()
+	defer stats.mx.Unlock()
+	if now.Sub(stats.windowStart) > window {
+		if stats.requests >= minRequests && !od.exceeded(stats) {
+			// Behaved for a whole window, forgive past ejections
+			stats.ejections = 0
+		}
+		stats.windowStart = now
+		stats.requests = 0
+		stats.errors = 0
+	}
+	stats.requests++
+	if failed {
+		stats.errors++
+	}
+	if stats.requests < minRequests || !od.exceeded(stats) {
+		return
+	}
+
+	ejection := od.ejection(stats.ejections)
+	log.Errorf("Upstream %v failed %d of %d requests, ejecting it for %v", u.url, stats.errors, stats.requests, ejection)
+	u.markDown(ejection)
+	stats.ejections++
+	// Start afresh once it's back
+	stats.windowStart = now.Add(ejection)
+	stats.requests = 0
+	stats.errors = 0
+}
+
+func (od *OutlierDetection) exceeded(stats *outlierStats) bool {
+	return float64(stats.errors)/float64(stats.requests) > od.ErrorRate
+}
+
+// ejection is how long to eject an upstream that was already ejected this
+// many times in a row
+func (od *OutlierDetection) ejection(ejections int) time.Duration {
+	base := od.BaseEjection
+	if base <= 0 {
+		base = defaultOutlierBaseEjection
+	}
+	max := od.MaxEjection
+	if max <= 0 {
+		max = defaultOutlierMaxEjection
+	}
+	d := base
+	for i := 0; i < ejections && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
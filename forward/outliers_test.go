@@ -0,0 +1,66 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("broken"))
+	}))
+	defer broken.Close()
+	brokenURL, _ := url.Parse(broken.URL)
+	a, aURL := namedOrigin("a")
+	defer a.Close()
+	b, bURL := namedOrigin("b")
+	defer b.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Upstreams:   []*url.URL{brokenURL, aURL, bURL},
+		OutlierDetection: &OutlierDetection{
+			ErrorRate:   0.5,
+			MinRequests: 2,
+		},
+	}))
+
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		counts[string(body)]++
+	}
+	assert.Equal(t, 2, counts["broken"], "broken upstream should have been ejected after MinRequests")
+	assert.Equal(t, 14, counts["a"])
+	assert.Equal(t, 14, counts["b"])
+}
+
+func TestOutlierEjectionBackoff(t *testing.T) {
+	od := &OutlierDetection{ErrorRate: 0.5, MinRequests: 1, BaseEjection: time.Second, MaxEjection: 5 * time.Second}
+	for ejections, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		assert.Equal(t, expected, od.ejection(ejections))
+	}
+
+	u := &upstream{}
+	od.record(u, true)
+	assert.InDelta(t, time.Second, time.Duration(u.downUntil-time.Now().UnixNano()), float64(100*time.Millisecond))
+	assert.Equal(t, 1, u.outliers.ejections)
+
+	// Failing again as soon as it's back doubles the ejection
+	u.outliers.windowStart = time.Now()
+	od.record(u, true)
+	assert.InDelta(t, 2*time.Second, time.Duration(u.downUntil-time.Now().UnixNano()), float64(100*time.Millisecond))
+	assert.Equal(t, 2, u.outliers.ejections)
+}
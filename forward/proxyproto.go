@@ -0,0 +1,112 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyProtocolAddrsKey struct{}
+
+type proxyProtocolAddrs struct {
+	src net.Addr
+	dst net.Addr
+}
+
+// withProxyProtocolAddrs attaches the addresses to send in the PROXY protocol
+// header to the outbound request, so that they're available when dialing. The
+// source is the client and the destination is the address it connected to.
+func withProxyProtocolAddrs(outReq *http.Request, req *http.Request) *http.Request {
+	addrs := &proxyProtocolAddrs{src: parseTCPAddr(req.RemoteAddr)}
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		addrs.dst = local
+	}
+	return outReq.WithContext(context.WithValue(outReq.Context(), proxyProtocolAddrsKey{}, addrs))
+}
+
+// writeProxyHeader writes the PROXY protocol header with the addresses in ctx
+// to the freshly dialed conn. Without addresses, or if they can't be
+// expressed, it writes a header that tells the upstream to use the
+// connection's own addresses.
+func writeProxyHeader(ctx context.Context, conn net.Conn, version int) error {
+	var src, dst *net.TCPAddr
+	if addrs, ok := ctx.Value(proxyProtocolAddrsKey{}).(*proxyProtocolAddrs); ok {
+		src, _ = addrs.src.(*net.TCPAddr)
+		dst, _ = addrs.dst.(*net.TCPAddr)
+	}
+	if dst == nil {
+		dst, _ = conn.RemoteAddr().(*net.TCPAddr)
+	}
+	if src != nil && dst != nil && (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		// Mixed address families can't be represented
+		src = nil
+	}
+
+	var header []byte
+	switch version {
+	case 1:
+		header = proxyHeaderV1(src, dst)
+	case 2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return fmt.Errorf("Unsupported PROXY protocol version %d", version)
+	}
+	_, err := conn.Write(header)
+	return err
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP4"
+	if src.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.IP, dst.IP, src.Port, dst.Port))
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Signature)
+	if src == nil || dst == nil {
+		// LOCAL command, no addresses
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	// PROXY command over TCP
+	buf.WriteByte(0x21)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP != nil {
+		buf.WriteByte(0x11)
+	} else {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		buf.WriteByte(0x21)
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
+
+func parseTCPAddr(addr string) net.Addr {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portString)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
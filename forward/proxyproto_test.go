@@ -0,0 +1,124 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+// proxyProtocolOrigin accepts connections starting with a PROXY protocol
+// header and responds to the HTTP requests that follow with the client IP
+// found in it.
+func proxyProtocolOrigin(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				clientIP, err := readProxyHeader(r)
+				if err != nil {
+					clientIP = "invalid: " + err.Error()
+				}
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+				resp := &http.Response{
+					StatusCode:    http.StatusOK,
+					ProtoMajor:    1,
+					ProtoMinor:    1,
+					Request:       req,
+					ContentLength: int64(len(clientIP)),
+					Body:          ioutil.NopCloser(strings.NewReader(clientIP)),
+					Close:         true,
+				}
+				resp.Write(conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func readProxyHeader(r *bufio.Reader) (string, error) {
+	sig, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(sig, proxyProtocolV2Signature) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == "UNKNOWN" {
+			return "local", nil
+		}
+		if len(fields) != 6 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return fields[2], nil
+	}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return "", err
+	}
+	switch {
+	case len(addrs) == 0:
+		return "local", nil
+	case header[13] == 0x11:
+		return net.IP(addrs[:4]).String(), nil
+	default:
+		return net.IP(addrs[:16]).String(), nil
+	}
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	l := proxyProtocolOrigin(t)
+	defer l.Close()
+
+	for _, version := range []int{1, 2} {
+		fwd := filters.Join(New(&Options{
+			IdleTimeout:       30 * time.Second,
+			SendProxyProtocol: version,
+		}))
+		for _, clientAddr := range []string{"203.0.113.7:5555", "[2001:db8::1]:5555"} {
+			req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+			req.RemoteAddr = clientAddr
+			w := httptest.NewRecorder()
+			fwd.ServeHTTP(w, req)
+			host, _, _ := net.SplitHostPort(clientAddr)
+			if clientAddr[0] == '[' {
+				// Can't mix IPv6 clients with the IPv4 origin, so the origin
+				// is told to use the connection's own addresses
+				assert.Equal(t, "local", w.Body.String(), "version %d", version)
+				continue
+			}
+			assert.Equal(t, host, w.Body.String(), "version %d", version)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package forward
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+const maxQuotaClients = 10000
+
+// BandwidthQuota caps how many bytes each client can send and receive through
+// the forwarder within a Window, counting the bodies of both requests and
+// responses. Clients are told apart by Key, the client IP (see
+// Options.ClientIPStrategy) by default. Once over quota, they get a 429 until
+// the window is over. The most recently active 10000 clients are tracked.
+type BandwidthQuota struct {
+	Key    func(req *http.Request) string
+	Bytes  int64
+	Window time.Duration
+}
+
+// quotaTracker keeps the bandwidth usage of clients
+type quotaTracker struct {
+	quota *BandwidthQuota
+	key   func(req *http.Request) string
+	usage *lru.Cache
+	mx    sync.Mutex
+}
+
+// quotaUsage is the bytes a client transferred since the start of its window
+type quotaUsage struct {
+	since time.Time
+	bytes int64
+}
+
+func newQuotaTracker(quota *BandwidthQuota, clientIP ClientIPStrategy) *quotaTracker {
+	key := quota.Key
+	if key == nil {
+		key = clientIP
+	}
+	// We can safely ignore the error, since the size is positive
+	usage, _ := lru.New(maxQuotaClients)
+	return &quotaTracker{quota: quota, key: key, usage: usage}
+}
+
+// usageOf returns the usage of the client making the request in the current
+// window
+func (t *quotaTracker) usageOf(req *http.Request) *quotaUsage {
+	key := t.key(req)
+	now := time.Now()
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if existing, found := t.usage.Get(key); found && now.Sub(existing.(*quotaUsage).since) <= t.quota.Window {
+		return existing.(*quotaUsage)
+	}
+	usage := &quotaUsage{since: now}
+	t.usage.Add(key, usage)
+	return usage
+}
+
+// exceeded tells whether the quota is used up, and if so, for how long
+func (t *quotaTracker) exceeded(usage *quotaUsage) (time.Duration, bool) {
+	if atomic.LoadInt64(&usage.bytes) < t.quota.Bytes {
+		return 0, false
+	}
+	return time.Until(usage.since.Add(t.quota.Window)), true
+}
+
+func (u *quotaUsage) add(n int64) {
+	atomic.AddInt64(&u.bytes, n)
+}
+
+// countingBody counts the bytes read from a request body towards the quota
+type countingBody struct {
+	io.ReadCloser
+	usage *quotaUsage
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.usage.add(int64(n))
+	return n, err
+}
@@ -0,0 +1,60 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestBandwidthQuota(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.Write([]byte(strings.Repeat("a", 40)))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		BandwidthQuota: &BandwidthQuota{
+			Key: func(req *http.Request) string {
+				return req.Header.Get("X-Tenant")
+			},
+			Bytes:  100,
+			Window: time.Hour,
+		},
+	}))
+	send := func(tenant string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", origin.URL, strings.NewReader(body))
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		return w
+	}
+
+	// 20 bytes up and 40 down each time
+	assert.Equal(t, http.StatusOK, send("heavy", strings.Repeat("b", 20)).Code)
+	assert.Equal(t, http.StatusOK, send("heavy", strings.Repeat("b", 20)).Code, "still under quota")
+	w := send("heavy", strings.Repeat("b", 20))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "3600", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send("light", "").Code, "other clients should be unaffected")
+}
+
+func TestBandwidthQuotaWindow(t *testing.T) {
+	tracker := newQuotaTracker(&BandwidthQuota{Bytes: 10, Window: 50 * time.Millisecond}, DirectRemoteAddr)
+	req := &http.Request{RemoteAddr: "1.2.3.4:5678"}
+	tracker.usageOf(req).add(10)
+	_, exceeded := tracker.exceeded(tracker.usageOf(req))
+	assert.True(t, exceeded)
+
+	time.Sleep(60 * time.Millisecond)
+	_, exceeded = tracker.exceeded(tracker.usageOf(req))
+	assert.False(t, exceeded, "quota should be back in a new window")
+}
@@ -0,0 +1,42 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// recycledConn is an upstream connection that counts the requests sent on it
+// for MaxRequestsPerConn
+type recycledConn struct {
+	net.Conn
+	requests int32
+}
+
+// withConnRecycling returns a copy of outReq that asks the upstream to close
+// the connection it gets after the response, if it's the MaxRequestsPerConn'th
+// request sent on it. Setting Close would be too late, the transport copied
+// the request by the time it has a connection, but the copy shares the
+// headers, which are only written after. With the response saying so, the
+// transport doesn't put the connection back in the idle pool.
+func (f *forwarder) withConnRecycling(outReq *http.Request) *http.Request {
+	header := outReq.Header
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+			if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+				conn = tlsConn.NetConn()
+			}
+			c, ok := conn.(*recycledConn)
+			if !ok {
+				return
+			}
+			if n := atomic.AddInt32(&c.requests, 1); int(n) >= f.MaxRequestsPerConn && !isUpgrade(header) {
+				log.Tracef("Recycling connection to %v after %d requests", c.RemoteAddr(), n)
+				header.Set("Connection", "close")
+			}
+		},
+	}
+	return outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), trace))
+}
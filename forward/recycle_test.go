@@ -0,0 +1,122 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	var mx sync.Mutex
+	var bodies []string
+	var closeRequested []bool
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mx.Lock()
+		bodies = append(bodies, string(body))
+		closeRequested = append(closeRequested, req.Close)
+		mx.Unlock()
+		w.Write([]byte("hello"))
+	}))
+	var closed int32
+	origin.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	// With a body, the transport works on a copy of the request
+	for _, method := range []string{"GET", "POST"} {
+		atomic.StoreInt32(&closed, 0)
+		mx.Lock()
+		closeRequested = nil
+		mx.Unlock()
+		var dials int32
+		fwd := filters.Join(New(&Options{
+			IdleTimeout:        30 * time.Second,
+			MaxRequestsPerConn: 3,
+			Dialer: func(network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				return net.Dial(network, addr)
+			},
+		}))
+		for i := 0; i < 7; i++ {
+			var body io.Reader
+			if method == "POST" {
+				body = strings.NewReader(fmt.Sprintf("body %d", i))
+			}
+			req, _ := http.NewRequest(method, origin.URL, body)
+			w := httptest.NewRecorder()
+			fwd.ServeHTTP(w, req)
+			assert.Equal(t, "hello", w.Body.String())
+		}
+
+		assert.EqualValues(t, 3, atomic.LoadInt32(&dials), "%v: should have dialed a new connection every 3 requests", method)
+		mx.Lock()
+		assert.Equal(t, []bool{false, false, true, false, false, true, false}, closeRequested, "%v: the last request on each connection should ask to close it", method)
+		mx.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		assert.EqualValues(t, 2, atomic.LoadInt32(&closed), "%v: the recycled connections should have been closed", method)
+	}
+	mx.Lock()
+	assert.Len(t, bodies, 14)
+	assert.Equal(t, "body 6", bodies[13], "bodies should have been sent")
+	mx.Unlock()
+}
+
+func TestMaxRequestsPerConnConcurrent(t *testing.T) {
+	var mx sync.Mutex
+	perConn := make(map[string]int)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mx.Lock()
+		perConn[req.RemoteAddr]++
+		mx.Unlock()
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		MaxRequestsPerConn: 3,
+	}))
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				// Hiding the length, the transport can't send the body again
+				body := fmt.Sprintf("body %d-%d", i, j)
+				req, _ := http.NewRequest("POST", origin.URL, ioutil.NopCloser(strings.NewReader(body)))
+				w := httptest.NewRecorder()
+				fwd.ServeHTTP(w, req)
+				if w.Code != http.StatusOK || w.Body.String() != body {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.EqualValues(t, 0, atomic.LoadInt32(&failed), "no request should fail because of recycling")
+	mx.Lock()
+	defer mx.Unlock()
+	for addr, n := range perConn {
+		assert.True(t, n <= 3, "%v served %d requests", addr, n)
+	}
+}
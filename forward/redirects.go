@@ -0,0 +1,59 @@
+package forward
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+const (
+	defaultRedirectLoopWindow = 10 * time.Second
+	maxRedirectClients        = 5000
+)
+
+// redirectTracker counts how many times each client gets redirected to each
+// location, to detect upstreams that keep sending clients around in circles
+type redirectTracker struct {
+	max      int
+	window   time.Duration
+	clientIP ClientIPStrategy
+	counts   *lru.Cache
+	mx       sync.Mutex
+}
+
+type redirectCount struct {
+	n     int
+	since time.Time
+}
+
+func newRedirectTracker(max int, window time.Duration, clientIP ClientIPStrategy) *redirectTracker {
+	if window <= 0 {
+		window = defaultRedirectLoopWindow
+	}
+	// We can safely ignore the error, since the size is positive
+	counts, _ := lru.New(maxRedirectClients)
+	return &redirectTracker{max: max, window: window, clientIP: clientIP, counts: counts}
+}
+
+// loops records a redirect of req to location and tells whether that has
+// happened more than the allowed number of times within the window
+func (t *redirectTracker) loops(req *http.Request, location string) bool {
+	key := t.clientIP(req) + " " + location
+	now := time.Now()
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	count := &redirectCount{since: now}
+	if existing, found := t.counts.Get(key); found && now.Sub(existing.(*redirectCount).since) <= t.window {
+		count = existing.(*redirectCount)
+	}
+	count.n++
+	t.counts.Add(key, count)
+	return count.n > t.max
+}
+
+func isRedirect(status int) bool {
+	return status >= 300 && status < 400 && status != http.StatusNotModified
+}
@@ -0,0 +1,50 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestRedirectLoop(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/a" {
+			http.Redirect(w, req, "/b", http.StatusFound)
+		} else {
+			http.Redirect(w, req, "/a", http.StatusFound)
+		}
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		MaxRedirectRepeats: 3,
+	}))
+
+	path := "/a"
+	requests := 0
+	for ; requests < 20; requests++ {
+		req, _ := http.NewRequest("GET", origin.URL+path, nil)
+		req.RemoteAddr = "1.2.3.4:5678"
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		if w.Code == http.StatusLoopDetected {
+			break
+		}
+		assert.Equal(t, http.StatusFound, w.Code)
+		path = w.Header().Get("Location")
+	}
+	assert.Equal(t, 6, requests, "should break the loop on the 4th redirect to the same location")
+
+	// Other clients aren't affected
+	req, _ := http.NewRequest("GET", origin.URL+"/a", nil)
+	req.RemoteAddr = "5.6.7.8:5678"
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+}
@@ -0,0 +1,40 @@
+package forward
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// RefererPolicy is what to do with the Referer header of requests on their way
+// upstream
+type RefererPolicy int
+
+const (
+	// RefererPassthrough forwards the Referer as is.
+	RefererPassthrough RefererPolicy = iota
+	// RefererDrop removes the Referer.
+	RefererDrop
+	// RefererStripToOrigin only keeps the scheme and host of the Referer
+	// ("https://www.example.com/"), like browsers do across origins.
+	RefererStripToOrigin
+)
+
+// apply applies the policy to the outbound header
+func (p RefererPolicy) apply(header http.Header) {
+	referer := header.Get("Referer")
+	if referer == "" {
+		return
+	}
+	switch p {
+	case RefererDrop:
+		header.Del("Referer")
+	case RefererStripToOrigin:
+		u, err := url.Parse(referer)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			// Can't tell its origin
+			header.Del("Referer")
+			return
+		}
+		header.Set("Referer", u.Scheme+"://"+u.Host+"/")
+	}
+}
@@ -0,0 +1,94 @@
+package forward
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PathRewrite replaces the parts of request paths that match Pattern with
+// Replacement, which can refer to capture groups as in regexp.Expand (e.g.
+// "/v2/$1"). Paths that don't match are left untouched.
+type PathRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+func (rw *PathRewrite) rewrite(u *url.URL) {
+	if !rw.Pattern.MatchString(u.Path) {
+		return
+	}
+	path := rw.Pattern.ReplaceAllString(u.Path, rw.Replacement)
+	log.Tracef("Rewriting path from %v to %v", u.Path, path)
+	u.Path = path
+	// Let it be escaped again from the new path
+	u.RawPath = ""
+}
+
+// cleanPath collapses duplicate slashes and resolves "." and ".." segments of
+// the path, keeping any trailing slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// hasTraversal tells whether the (decoded) path has "." or ".." segments
+func hasTraversal(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// modifyRequest applies the configured changes to the outbound request after
+// it has been cloned from the original req and rewritten.
+func (f *forwarder) modifyRequest(outReq *http.Request, req *http.Request) *http.Request {
+	if f.SendProxyProtocol > 0 {
+		outReq = withProxyProtocolAddrs(outReq, req)
+		outReq.Close = true
+	}
+	if f.ForwardClientCert {
+		setClientCertHeaders(outReq)
+	}
+	if f.ProtoVersionHeader != "" {
+		outReq.Header.Set(f.ProtoVersionHeader, req.Proto)
+	}
+	if f.ClientIPStrategy != nil {
+		// Take it from the original request, before the Rewriter added to the
+		// X-Forwarded-For chain
+		outReq.Header.Set(XRealIP, f.ClientIPStrategy(req))
+	}
+	dropHeaders(outReq.Header, f.DropRequestHeaders)
+	if len(f.ForwardOnlyHeaders) > 0 {
+		keepHeaders(outReq.Header, f.ForwardOnlyHeaders)
+	}
+	if f.ConnectionPolicy != nil && !f.ConnectionPolicy(req) {
+		outReq.Close = true
+	}
+	if f.OnRequest != nil {
+		f.OnRequest(outReq)
+	}
+	return outReq
+}
+
+// headerBytes is the size of the header on the wire, as "Key: value\r\n"
+// lines
+func headerBytes(header http.Header) int {
+	n := 0
+	for k, vv := range header {
+		for _, v := range vv {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
@@ -0,0 +1,296 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LocationRewrite describes how to rewrite the Location header of responses.
+// From and To are either bare hosts ("internal:8080") or scheme and host
+// ("https://www.example.com"). Relative locations are left untouched.
+type LocationRewrite struct {
+	From string
+	To   string
+	// ContentLocation also rewrites the Content-Location header
+	ContentLocation bool
+}
+
+// CookieRewrite describes how to rewrite the Set-Cookie headers of responses.
+// Cookies whose Domain matches DomainFrom get DomainTo instead, and if PathFrom
+// is set, paths starting with it get that prefix replaced by PathTo. The other
+// attributes are preserved as sent by the upstream.
+type CookieRewrite struct {
+	DomainFrom string
+	DomainTo   string
+	PathFrom   string
+	PathTo     string
+}
+
+// validateResponse enforces the configured limits on the upstream response,
+// either trimming it or returning an error if it must be rejected.
+func (f *forwarder) validateResponse(resp *http.Response) error {
+	if err := checkContentLength(resp.Header); err != nil {
+		return &InvalidResponseError{err}
+	}
+	if f.MaxResponseHeaders > 0 {
+		if n := countHeaders(resp.Header); n > f.MaxResponseHeaders {
+			if f.StrictResponseHeaders {
+				return fmt.Errorf("Upstream sent %d headers, more than the %d allowed", n, f.MaxResponseHeaders)
+			}
+			log.Debugf("Upstream sent %d headers, dropping all but the first %d", n, f.MaxResponseHeaders)
+			truncateHeaders(resp.Header, f.MaxResponseHeaders)
+		}
+	}
+	return nil
+}
+
+// checkContentLength rejects conflicting Content-Length values, which could
+// make the client and intermediaries disagree on where the response ends.
+// Repeating the same value is tolerated, like net/http does.
+func checkContentLength(header http.Header) error {
+	var length string
+	for _, v := range header[ContentLength] {
+		for _, l := range strings.Split(v, ",") {
+			l = strings.TrimSpace(l)
+			if length == "" {
+				length = l
+			} else if l != length {
+				return fmt.Errorf("Conflicting Content-Length values %v", header[ContentLength])
+			}
+		}
+	}
+	return nil
+}
+
+func countHeaders(header http.Header) int {
+	n := 0
+	for _, vv := range header {
+		n += len(vv)
+	}
+	return n
+}
+
+// truncateHeaders keeps the first max header lines, taking the keys in sorted
+// order so that the outcome is deterministic.
+func truncateHeaders(header http.Header, max int) {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vv := header[k]
+		switch {
+		case max <= 0:
+			delete(header, k)
+		case len(vv) > max:
+			header[k] = vv[:max]
+			max = 0
+		default:
+			max -= len(vv)
+		}
+	}
+}
+
+// ResponseStage is a named step of the pipeline that modifies upstream
+// responses before they're forwarded.
+type ResponseStage struct {
+	Name   string
+	Order  int
+	Modify func(resp *http.Response)
+}
+
+// The order of the built in response stages, so that custom ones can be
+// placed before or after them. Stages with the same order run in the order
+// they were registered, built in ones first.
+const (
+	ResponseStageRewriteStatus   = 50
+	ResponseStageReasonPhrase    = 60
+	ResponseStageDropHeaders     = 100
+	ResponseStageServerHeader    = 150
+	ResponseStageSecurityHeaders = 160
+	ResponseStageRewriteLocation = 200
+	ResponseStageRewriteCookies  = 300
+	ResponseStageOnResponse      = 400
+)
+
+// DefaultSecurityHeaders returns a common set of security headers for
+// responses that go to browsers, to be used as Options.SecurityHeaders.
+func DefaultSecurityHeaders() http.Header {
+	return http.Header{
+		"Strict-Transport-Security": {"max-age=31536000; includeSubDomains"},
+		"X-Content-Type-Options":    {"nosniff"},
+		"X-Frame-Options":           {"DENY"},
+		"Referrer-Policy":           {"strict-origin-when-cross-origin"},
+	}
+}
+
+// addMissingHeaders adds the headers in extra that aren't in header yet
+func addMissingHeaders(header http.Header, extra http.Header) {
+	for k, vv := range extra {
+		k = http.CanonicalHeaderKey(k)
+		if _, found := header[k]; !found {
+			header[k] = append([]string(nil), vv...)
+		}
+	}
+}
+
+// buildResponseStages puts together the built in stages that are enabled and
+// the custom ones, sorted by order
+func (f *forwarder) buildResponseStages() []ResponseStage {
+	var stages []ResponseStage
+	if len(f.RewriteStatus) > 0 {
+		stages = append(stages, ResponseStage{"rewrite status", ResponseStageRewriteStatus, func(resp *http.Response) {
+			if status, found := f.RewriteStatus[resp.StatusCode]; found {
+				resp.StatusCode = status
+				resp.Status = fmt.Sprintf("%d %v", status, http.StatusText(status))
+			}
+		}})
+	}
+	if f.ReasonPhraseHeader != "" {
+		stages = append(stages, ResponseStage{"reason phrase", ResponseStageReasonPhrase, func(resp *http.Response) {
+			if reason := reasonPhrase(resp); reason != "" && reason != http.StatusText(resp.StatusCode) {
+				resp.Header.Set(f.ReasonPhraseHeader, reason)
+			}
+		}})
+	}
+	if len(f.DropResponseHeaders) > 0 {
+		stages = append(stages, ResponseStage{"drop headers", ResponseStageDropHeaders, func(resp *http.Response) {
+			dropHeaders(resp.Header, f.DropResponseHeaders)
+		}})
+	}
+	if f.OverrideServerHeader {
+		stages = append(stages, ResponseStage{"server header", ResponseStageServerHeader, func(resp *http.Response) {
+			if f.ServerHeader == "" {
+				resp.Header.Del("Server")
+			} else {
+				resp.Header.Set("Server", f.ServerHeader)
+			}
+		}})
+	}
+	if len(f.SecurityHeaders) > 0 {
+		stages = append(stages, ResponseStage{"security headers", ResponseStageSecurityHeaders, func(resp *http.Response) {
+			addMissingHeaders(resp.Header, f.SecurityHeaders)
+		}})
+	}
+	if rw := f.RewriteLocationHeader; rw != nil {
+		stages = append(stages, ResponseStage{"rewrite location", ResponseStageRewriteLocation, func(resp *http.Response) {
+			rw.rewrite(resp.Header, "Location")
+			if rw.ContentLocation {
+				rw.rewrite(resp.Header, "Content-Location")
+			}
+		}})
+	}
+	if rw := f.RewriteCookies; rw != nil {
+		stages = append(stages, ResponseStage{"rewrite cookies", ResponseStageRewriteCookies, func(resp *http.Response) {
+			cookies := resp.Header["Set-Cookie"]
+			for i, cookie := range cookies {
+				cookies[i] = rw.rewrite(cookie)
+			}
+		}})
+	}
+	if f.OnResponse != nil {
+		stages = append(stages, ResponseStage{"on response", ResponseStageOnResponse, f.OnResponse})
+	}
+	stages = append(stages, f.ResponseStages...)
+	sort.SliceStable(stages, func(i, j int) bool {
+		return stages[i].Order < stages[j].Order
+	})
+	return stages
+}
+
+// reasonPhrase extracts the reason phrase from the status line of the
+// response, as in "404 Not Found"
+func reasonPhrase(resp *http.Response) string {
+	code := strconv.Itoa(resp.StatusCode)
+	return strings.TrimSpace(strings.TrimPrefix(resp.Status, code))
+}
+
+// modifyResponse runs the response stages on the upstream response before
+// it's forwarded to the client.
+func (f *forwarder) modifyResponse(resp *http.Response) {
+	for _, stage := range f.responseStages {
+		log.Tracef("Running response stage %v", stage.Name)
+		stage.Modify(resp)
+	}
+}
+
+func (rw *LocationRewrite) rewrite(header http.Header, key string) {
+	location := header.Get(key)
+	if location == "" {
+		return
+	}
+	if rewritten := rewriteLocation(location, rw.From, rw.To); rewritten != location {
+		log.Tracef("Rewriting %v header from %v to %v", key, location, rewritten)
+		header.Set(key, rewritten)
+	}
+}
+
+func rewriteLocation(location, from, to string) string {
+	loc, err := url.Parse(location)
+	if err != nil || loc.Host == "" {
+		// Unparseable or relative, nothing to rewrite
+		return location
+	}
+
+	fromScheme, fromHost := splitSchemeHost(from)
+	if !strings.EqualFold(loc.Host, fromHost) || (fromScheme != "" && loc.Scheme != fromScheme) {
+		return location
+	}
+	toScheme, toHost := splitSchemeHost(to)
+	loc.Host = toHost
+	if toScheme != "" && loc.Scheme != "" {
+		loc.Scheme = toScheme
+	}
+	return loc.String()
+}
+
+func splitSchemeHost(s string) (scheme string, host string) {
+	if !strings.Contains(s, "://") {
+		return "", s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", s
+	}
+	return u.Scheme, u.Host
+}
+
+// rewrite rewrites the attributes of a single Set-Cookie header value. It
+// works on the raw attributes rather than going through http.Cookie so that
+// attributes unknown to net/http survive untouched.
+func (rw *CookieRewrite) rewrite(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	// The first part is the name=value pair
+	for i := 1; i < len(parts); i++ {
+		attr := strings.TrimSpace(parts[i])
+		eq := strings.Index(attr, "=")
+		if eq < 0 {
+			continue
+		}
+		name, value := attr[:eq], attr[eq+1:]
+		switch strings.ToLower(name) {
+		case "domain":
+			if rw.DomainFrom != "" && strings.EqualFold(strings.TrimPrefix(value, "."), strings.TrimPrefix(rw.DomainFrom, ".")) {
+				domain := strings.TrimPrefix(rw.DomainTo, ".")
+				if strings.HasPrefix(value, ".") {
+					domain = "." + domain
+				}
+				parts[i] = " " + name + "=" + domain
+			}
+		case "path":
+			if rw.PathFrom != "" && strings.HasPrefix(value, rw.PathFrom) {
+				path := rw.PathTo + strings.TrimPrefix(value, rw.PathFrom)
+				if path == "" {
+					path = "/"
+				}
+				parts[i] = " " + name + "=" + path
+			}
+		}
+	}
+	return strings.Join(parts, ";")
+}
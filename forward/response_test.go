@@ -0,0 +1,467 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestRewriteLocationHeader(t *testing.T) {
+	var originHost string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/absolute":
+			w.Header().Set("Location", "http://"+originHost+"/login?next=%2F")
+			w.Header().Set("Content-Location", "http://"+originHost+"/absolute")
+		case "/relative":
+			w.Header().Set("Location", "/login")
+		case "/elsewhere":
+			w.Header().Set("Location", "http://other.com/login")
+		}
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+	originHost = u.Host
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		RewriteLocationHeader: &LocationRewrite{
+			From:            originHost,
+			To:              "https://www.example.com",
+			ContentLocation: true,
+		},
+	}))
+
+	tests := []struct {
+		path            string
+		location        string
+		contentLocation string
+	}{
+		{"/absolute", "https://www.example.com/login?next=%2F", "https://www.example.com/absolute"},
+		{"/relative", "/login", ""},
+		{"/elsewhere", "http://other.com/login", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", origin.URL+test.path, nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, test.location, w.Header().Get("Location"), "wrong Location for %v", test.path)
+		assert.Equal(t, test.contentLocation, w.Header().Get("Content-Location"), "wrong Content-Location for %v", test.path)
+	}
+}
+
+func TestRewriteCookies(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Domain=internal.local; Path=/app/; Secure; HttpOnly; SameSite=Strict")
+		w.Header().Add("Set-Cookie", "pref=dark; domain=.INTERNAL.local; Max-Age=3600")
+		w.Header().Add("Set-Cookie", "other=1; Domain=other.com; Path=/app")
+		w.Header().Add("Set-Cookie", "plain=2")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		RewriteCookies: &CookieRewrite{
+			DomainFrom: "internal.local",
+			DomainTo:   "www.example.com",
+			PathFrom:   "/app",
+			PathTo:     "/public",
+		},
+	}))
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, []string{
+		"session=abc; Domain=www.example.com; Path=/public/; Secure; HttpOnly; SameSite=Strict",
+		"pref=dark; domain=.www.example.com; Max-Age=3600",
+		"other=1; Domain=other.com; Path=/public",
+		"plain=2",
+	}, w.Header()["Set-Cookie"])
+}
+
+func TestMaxResponseHeaders(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 1000; i++ {
+			w.Header().Set(fmt.Sprintf("X-Header-%04d", i), "value")
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	lenient := filters.Join(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		MaxResponseHeaders: 50,
+	}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	lenient.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+	assert.Equal(t, 50, countHeaders(w.Header()), "should have dropped the extra headers")
+
+	strict := filters.Join(New(&Options{
+		IdleTimeout:           30 * time.Second,
+		MaxResponseHeaders:    50,
+		StrictResponseHeaders: true,
+	}))
+	req, _ = http.NewRequest("GET", origin.URL, nil)
+	w = httptest.NewRecorder()
+	strict.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Empty(t, w.Header().Get("X-Header-0000"), "should not forward any upstream header")
+}
+
+func TestNoBodyResponses(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/nocontent":
+			w.WriteHeader(http.StatusNoContent)
+		case req.Header.Get("If-None-Match") == `"v1"`:
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("content"))
+		}
+	}))
+	defer origin.Close()
+
+	client, closeProxy := proxiedClient(New(&Options{IdleTimeout: 30 * time.Second}))
+	defer closeProxy()
+	client.Timeout = 2 * time.Second
+
+	tests := []struct {
+		path        string
+		ifNoneMatch string
+		status      int
+		body        string
+	}{
+		{"/nocontent", "", http.StatusNoContent, ""},
+		{"/cached", `"v1"`, http.StatusNotModified, ""},
+		{"/cached", "", http.StatusOK, "content"},
+		// Run them again over the same connection to make sure it didn't stall
+		{"/nocontent", "", http.StatusNoContent, ""},
+		{"/cached", `"v1"`, http.StatusNotModified, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", origin.URL+test.path, nil)
+		if test.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err, "request to %v should not stall", test.path) {
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, test.status, resp.StatusCode)
+		assert.Equal(t, test.body, string(b))
+		if test.status == http.StatusNoContent {
+			assert.Empty(t, resp.Header.Get("Content-Length"), "204 should not have a Content-Length")
+		}
+	}
+}
+
+// trackedBody is a response body that records whether it was read or closed
+type trackedBody struct {
+	io.Reader
+	reads  int32
+	closed int32
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	atomic.AddInt32(&b.reads, 1)
+	return b.Reader.Read(p)
+}
+
+func (b *trackedBody) Close() error {
+	atomic.StoreInt32(&b.closed, 1)
+	return nil
+}
+
+func TestNoBodyResponsesNotRead(t *testing.T) {
+	tests := []struct {
+		method        string
+		status        int
+		body          string
+		contentLength string
+	}{
+		{"HEAD", http.StatusOK, "", "7"},
+		{"GET", http.StatusNoContent, "", ""},
+		{"GET", http.StatusNotModified, "", "7"},
+		{"CONNECT", http.StatusOK, "", ""},
+		{"CONNECT", http.StatusProxyAuthRequired, "content", "7"},
+		{"GET", http.StatusOK, "content", "7"},
+	}
+	for _, test := range tests {
+		body := &trackedBody{Reader: strings.NewReader("content")}
+		fwd := filters.Join(New(&Options{
+			IdleTimeout:      30 * time.Second,
+			FirstByteTimeout: time.Second,
+			RoundTripper: mockRT{func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode:    test.status,
+					Header:        http.Header{ContentLength: {"7"}},
+					ContentLength: 7,
+					Body:          body,
+					Request:       req,
+				}, nil
+			}},
+		}))
+		req, _ := http.NewRequest(test.method, "http://example.com:443", nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+
+		assert.Equal(t, test.status, w.Code, "%v %d", test.method, test.status)
+		assert.Equal(t, test.body, w.Body.String(), "%v %d", test.method, test.status)
+		assert.Equal(t, test.contentLength, w.Header().Get(ContentLength), "%v %d", test.method, test.status)
+		if test.body == "" {
+			assert.Zero(t, atomic.LoadInt32(&body.reads), "%v %d should not have read the body", test.method, test.status)
+		}
+		assert.EqualValues(t, 1, atomic.LoadInt32(&body.closed), "%v %d should have closed the body", test.method, test.status)
+	}
+}
+
+func TestConflictingContentLength(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nX-Upstream: yes\r\nContent-Length: 5\r\nContent-Length: 50\r\n\r\nhello"))
+			}()
+		}
+	}()
+
+	fwd := filters.Join(New(&Options{IdleTimeout: 30 * time.Second}))
+	req, _ := http.NewRequest("GET", "http://"+l.Addr().String(), nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Empty(t, w.Header().Get("X-Upstream"), "nothing from the upstream should be forwarded")
+	assert.NotContains(t, w.Body.String(), "hello")
+
+	// Custom round trippers don't get the checks of net/http
+	rt := mockRT{func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Length": {"5", "50"}, "X-Upstream": {"yes"}},
+			Body:       ioutil.NopCloser(strings.NewReader("hello")),
+		}, nil
+	}}
+	fwd = filters.Join(New(&Options{RoundTripper: rt}))
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Empty(t, w.Header().Get("X-Upstream"))
+	assert.NotContains(t, w.Body.String(), "hello")
+
+	assert.NoError(t, checkContentLength(http.Header{"Content-Length": {"5", "5"}}), "repeating the same value is fine")
+	assert.Error(t, checkContentLength(http.Header{"Content-Length": {"5, 6"}}))
+}
+
+func TestResponseStages(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Location", "http://internal:8080/next")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer origin.Close()
+
+	var ran []string
+	stage := func(name string, order int) ResponseStage {
+		return ResponseStage{name, order, func(resp *http.Response) {
+			ran = append(ran, name+" "+resp.Header.Get("Location"))
+		}}
+	}
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:           30 * time.Second,
+		RewriteLocationHeader: &LocationRewrite{From: "internal:8080", To: "www.example.com"},
+		OnResponse: func(resp *http.Response) {
+			ran = append(ran, "on response")
+		},
+		ResponseStages: []ResponseStage{
+			stage("last", 1000),
+			stage("after location", ResponseStageRewriteLocation+1),
+			stage("first", 0),
+			stage("also last", 1000),
+		},
+	}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, []string{
+		"first http://internal:8080/next",
+		"after location http://www.example.com/next",
+		"on response",
+		"last http://www.example.com/next",
+		"also last http://www.example.com/next",
+	}, ran)
+}
+
+func TestServerHeader(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server", "Apache/2.4.1 (Unix)")
+	}))
+	defer origin.Close()
+
+	for _, test := range []struct {
+		override bool
+		value    string
+		expected []string
+	}{
+		{false, "", []string{"Apache/2.4.1 (Unix)"}},
+		{true, "proxy", []string{"proxy"}},
+		{true, "", nil},
+	} {
+		fwd := filters.Join(New(&Options{
+			IdleTimeout:          30 * time.Second,
+			OverrideServerHeader: test.override,
+			ServerHeader:         test.value,
+		}))
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, test.expected, w.Header()["Server"])
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}))
+	defer origin.Close()
+
+	headers := DefaultSecurityHeaders()
+	headers.Set("Content-Security-Policy", "default-src 'self'")
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:     30 * time.Second,
+		SecurityHeaders: headers,
+	}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+
+	assert.Equal(t, []string{"SAMEORIGIN"}, w.Header()["X-Frame-Options"], "should keep the upstream's value without duplicating it")
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "max-age=31536000; includeSubDomains", w.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "default-src 'self'", w.Header().Get("Content-Security-Policy"))
+}
+
+func TestRewriteStatus(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:   30 * time.Second,
+		RewriteStatus: map[int]int{http.StatusTeapot: http.StatusBadRequest},
+	}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "short and stout", w.Body.String())
+}
+
+func TestReasonPhraseHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				reason := "OK"
+				if req.URL.Path == "/custom" {
+					reason = "Alright"
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 200 %v\r\nContent-Length: 5\r\n\r\nhello", reason)
+			}()
+		}
+	}()
+
+	client, stop := proxiedClient(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		ReasonPhraseHeader: "X-Reason-Phrase",
+	}))
+	defer stop()
+
+	resp, err := client.Get("http://" + l.Addr().String() + "/custom")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "Alright", resp.Header.Get("X-Reason-Phrase"))
+	}
+
+	resp, err = client.Get("http://" + l.Addr().String() + "/standard")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Empty(t, resp.Header.Get("X-Reason-Phrase"), "standard reason phrases don't need to be sent")
+	}
+}
+
+func TestEchoRequestHeaders(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Request-Id", "from upstream")
+		w.Header().Set("X-Upstream", "yes")
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		EchoRequestHeaders: []string{"x-request-id", "X-Trace", "X-Missing"},
+	}))
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	req.Header.Add("X-Trace", "one")
+	req.Header.Add("X-Trace", "two")
+	req.Header.Set("X-Not-Echoed", "no")
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+
+	assert.Equal(t, "hello", w.Body.String())
+	assert.Equal(t, []string{"abc123"}, w.Header()["X-Request-Id"], "should replace the upstream's")
+	assert.Equal(t, []string{"one", "two"}, w.Header()["X-Trace"])
+	assert.Equal(t, "yes", w.Header().Get("X-Upstream"))
+	assert.Empty(t, w.Header().Get("X-Not-Echoed"))
+	_, found := w.Header()["X-Missing"]
+	assert.False(t, found)
+}
@@ -0,0 +1,42 @@
+package forward
+
+import (
+	"sync"
+)
+
+// retryBudgetReserve is how many retries the budget starts with and can save
+// up
+const retryBudgetReserve = 10
+
+// retryBudget is a token bucket filled by requests and drained by retries
+type retryBudget struct {
+	ratio  float64
+	tokens float64
+	mx     sync.Mutex
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, tokens: retryBudgetReserve}
+}
+
+// deposit earns the retries of a request
+func (b *retryBudget) deposit() {
+	b.mx.Lock()
+	b.tokens += b.ratio
+	if b.tokens > retryBudgetReserve {
+		b.tokens = retryBudgetReserve
+	}
+	b.mx.Unlock()
+}
+
+// withdraw takes a retry from the budget, returning false if there's none
+// left
+func (b *retryBudget) withdraw() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
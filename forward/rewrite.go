@@ -1,17 +1,25 @@
 package forward
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"net"
 	"net/http"
 	"strings"
 )
 
 const (
-	XForwardedProto  = "X-Forwarded-Proto"
-	XForwardedFor    = "X-Forwarded-For"
-	XForwardedHost   = "X-Forwarded-Host"
-	XForwardedServer = "X-Forwarded-Server"
-	ContentLength    = "Content-Length"
+	XForwardedProto        = "X-Forwarded-Proto"
+	XForwardedFor          = "X-Forwarded-For"
+	XForwardedHost         = "X-Forwarded-Host"
+	XForwardedServer       = "X-Forwarded-Server"
+	XForwardedProtoVersion = "X-Forwarded-Proto-Version"
+	XRealIP                = "X-Real-IP"
+	ContentLength          = "Content-Length"
+
+	XClientCertSubject     = "X-Client-Cert-Subject"
+	XClientCertIssuer      = "X-Client-Cert-Issuer"
+	XClientCertFingerprint = "X-Client-Cert-Fingerprint"
 )
 
 // Rewriter is responsible for removing hop-by-hop headers and setting forwarding headers
@@ -51,3 +59,20 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 		req.Header.Set(XForwardedServer, rw.Hostname)
 	}
 }
+
+// setClientCertHeaders sets the X-Client-Cert-* headers from the leaf
+// certificate presented by the client, if any. Headers sent by the client
+// itself are always removed so that they can't be spoofed.
+func setClientCertHeaders(req *http.Request) {
+	req.Header.Del(XClientCertSubject)
+	req.Header.Del(XClientCertIssuer)
+	req.Header.Del(XClientCertFingerprint)
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return
+	}
+	cert := req.TLS.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	req.Header.Set(XClientCertSubject, cert.Subject.String())
+	req.Header.Set(XClientCertIssuer, cert.Issuer.String())
+	req.Header.Set(XClientCertFingerprint, hex.EncodeToString(fingerprint[:]))
+}
@@ -0,0 +1,64 @@
+package forward
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestForwardClientCert(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client.example.com", Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert, _ := x509.ParseCertificate(der)
+	fingerprint := sha256.Sum256(der)
+
+	received := make(chan http.Header, 2)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:       30 * time.Second,
+		ForwardClientCert: true,
+	}))
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+	header := <-received
+	assert.Equal(t, "CN=client.example.com,O=Example", header.Get(XClientCertSubject))
+	assert.Equal(t, hex.EncodeToString(fingerprint[:]), header.Get(XClientCertFingerprint))
+
+	// Without a client certificate, spoofed headers must not get through
+	req, _ = http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set(XClientCertSubject, "CN=spoofed")
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+	header = <-received
+	assert.Empty(t, header.Get(XClientCertSubject))
+}
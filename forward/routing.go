@@ -0,0 +1,205 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Route tells the forwarder where to send a request, and how
+type Route struct {
+	URL *url.URL
+	// Timeout bounds the whole exchange with the upstream, body included.
+	// Requests that don't get a response in time fail with a 504.
+	Timeout time.Duration
+	// Retries is how many more times to try if the round trip fails, for
+	// requests that can be resent: idempotent ones (including those with an
+	// Idempotency-Key header), and others only if the upstream couldn't be
+	// dialed, as they might have been acted upon otherwise.
+	Retries int
+}
+
+// routeFor picks the route the request should take, or nil if it should be
+// forwarded to the host it was addressed to.
+func (f *forwarder) routeFor(req *http.Request) *Route {
+	if f.Router != nil {
+		if route := f.Router(req); route != nil {
+			return route
+		}
+	}
+	if len(f.RouteBySNI) > 0 {
+		if u, found := f.RouteBySNI[SNI(req)]; found {
+			return &Route{URL: u}
+		}
+	}
+	if len(f.RouteByPriority) > 0 {
+		if u, found := f.RouteByPriority[f.priority(req)]; found {
+			return &Route{URL: u}
+		}
+	}
+	if len(f.RouteByContentType) > 0 {
+		mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err == nil {
+			if u, found := f.RouteByContentType[mediaType]; found {
+				return &Route{URL: u}
+			}
+		}
+	}
+	return nil
+}
+
+// SNI returns the server name the client asked for when establishing the TLS
+// connection the request came in on, lower cased, or "" if there was none.
+func SNI(req *http.Request) string {
+	if req.TLS == nil {
+		return ""
+	}
+	return strings.ToLower(req.TLS.ServerName)
+}
+
+// priority returns the priority of the request from its PriorityHeader, lower
+// cased
+func (f *forwarder) priority(req *http.Request) string {
+	header := f.PriorityHeader
+	if header == "" {
+		header = "Priority"
+	}
+	return strings.ToLower(strings.TrimSpace(req.Header.Get(header)))
+}
+
+// retry resends the request as many times as the route allows while the
+// round trip fails.
+func (f *forwarder) retry(route *Route, outReq *http.Request, resp *http.Response, err error) (*http.Request, *http.Response, error) {
+	for i := 0; err != nil && i < route.Retries && retryable(outReq, err) && outReq.Context().Err() == nil; i++ {
+		if f.retries != nil && !f.retries.withdraw() {
+			log.Debugf("Retry budget exhausted, not retrying %v after error: %v", outReq.URL, err)
+			break
+		}
+		log.Debugf("Retrying %v after error: %v", outReq.URL, err)
+		outReq, err = resend(outReq)
+		if err == nil {
+			resp, err = f.roundTrip(outReq)
+		}
+	}
+	return outReq, resp, err
+}
+
+// fallsBack tells whether the response calls for retrying the request against
+// the FallbackUpstream
+func (f *forwarder) fallsBack(outReq *http.Request, resp *http.Response) bool {
+	if f.FallbackUpstream == nil || !containsStatus(f.FallbackOnStatus, resp.StatusCode) {
+		return false
+	}
+	return resendable(outReq)
+}
+
+// fallbackRequest readdresses the outbound request to the FallbackUpstream
+func (f *forwarder) fallbackRequest(outReq *http.Request) (*http.Request, error) {
+	fallback, err := resend(outReq)
+	if err != nil {
+		return nil, err
+	}
+	fallback.URL.Scheme = f.FallbackUpstream.Scheme
+	fallback.URL.Host = f.FallbackUpstream.Host
+	if f.UpstreamHostHeader {
+		fallback.Host = f.FallbackUpstream.Host
+		fallback.Header.Set("Host", fallback.Host)
+	}
+	return f.exposeUpstream(fallback), nil
+}
+
+// exposeUpstream stores the upstream the request is addressed to in its
+// context, under UpstreamContextKey
+func (f *forwarder) exposeUpstream(outReq *http.Request) *http.Request {
+	if f.UpstreamContextKey == nil {
+		return outReq
+	}
+	ctx := context.WithValue(outReq.Context(), f.UpstreamContextKey, outReq.URL.Host)
+	return outReq.WithContext(ctx)
+}
+
+// maxReplayBodyBytes is the size of the largest bodies kept in memory to be
+// resent
+const maxReplayBodyBytes = 1 << 20
+
+// mayResend tells whether requests on the route may be sent more than once
+func (f *forwarder) mayResend(route *Route) bool {
+	return (route != nil && route.Retries > 0) || (f.FallbackUpstream != nil && len(f.FallbackOnStatus) > 0)
+}
+
+// bufferForReplay reads bodies of known length up to maxReplayBodyBytes into
+// memory, so that retries, fallbacks and the transport itself can send them
+// again. Streamed and larger bodies are sent only once.
+func bufferForReplay(outReq *http.Request) error {
+	if outReq.GetBody != nil || outReq.Body == nil || outReq.Body == http.NoBody {
+		return nil
+	}
+	if outReq.ContentLength <= 0 || outReq.ContentLength > maxReplayBodyBytes {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(outReq.Body, outReq.ContentLength))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) != outReq.ContentLength {
+		return errRequestBodyIncomplete
+	}
+	outReq.Body.Close()
+	setBody(outReq, body)
+	return nil
+}
+
+// resendable tells whether the request can be sent again: if it has no body
+// or the body can be replayed
+func resendable(outReq *http.Request) bool {
+	return outReq.Body == nil || outReq.Body == http.NoBody || outReq.GetBody != nil
+}
+
+// retryable tells whether the request can be sent again after failing with
+// err, without risking it being acted upon twice
+func retryable(outReq *http.Request, err error) bool {
+	if !resendable(outReq) {
+		return false
+	}
+	var dialErr *DialError
+	return idempotent(outReq) || errors.As(err, &dialErr)
+}
+
+// idempotent tells whether sending the request several times has the same
+// effect as sending it once (section 4.2.2 of RFC 7231), or the client says so
+// with an Idempotency-Key
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// resend returns a copy of the request to send again, with its body rewound
+func resend(outReq *http.Request) (*http.Request, error) {
+	again := outReq.Clone(outReq.Context())
+	if outReq.GetBody != nil {
+		body, err := outReq.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		again.Body = body
+	}
+	return again, nil
+}
+
+func containsStatus(codes []int, status int) bool {
+	for _, code := range codes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
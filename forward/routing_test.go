@@ -0,0 +1,526 @@
+package forward
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+// namedOrigin starts an origin server that responds with its own name
+func namedOrigin(name string) (*httptest.Server, *url.URL) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(name))
+	}))
+	u, _ := url.Parse(origin.URL)
+	return origin, u
+}
+
+func TestRouteByContentType(t *testing.T) {
+	defaultOrigin, defaultURL := namedOrigin("default")
+	defer defaultOrigin.Close()
+	storage, storageURL := namedOrigin("storage")
+	defer storage.Close()
+	api, apiURL := namedOrigin("api")
+	defer api.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		RouteByContentType: map[string]*url.URL{
+			"multipart/form-data": storageURL,
+			"application/json":    apiURL,
+		},
+	}))
+
+	tests := []struct {
+		contentType string
+		expected    string
+	}{
+		{"multipart/form-data; boundary=xyz", "storage"},
+		{"application/json", "api"},
+		{"text/plain", "default"},
+		{"", "default"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", defaultURL.String(), strings.NewReader("body"))
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, test.expected, w.Body.String(), "wrong backend for %q", test.contentType)
+	}
+}
+
+func TestUpstreamHostHeaderHTTP2(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Over HTTP/2, req.Host is populated from :authority
+		w.Write([]byte(req.Proto + " " + req.Host))
+	}))
+	origin.Config.Protocols = h2cProtocols()
+	origin.Start()
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	for _, upstreamHost := range []bool{false, true} {
+		fwd := filters.Join(New(&Options{
+			IdleTimeout:        30 * time.Second,
+			Upstreams:          []*url.URL{originURL},
+			UpstreamH2C:        true,
+			UpstreamHostHeader: upstreamHost,
+		}))
+		req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		expected := "HTTP/2.0 www.example.com"
+		if upstreamHost {
+			expected = "HTTP/2.0 " + originURL.Host
+		}
+		assert.Equal(t, expected, w.Body.String())
+	}
+}
+
+func TestFallbackOnStatus(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	fallback, fallbackURL := namedOrigin("fallback")
+	defer fallback.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:      30 * time.Second,
+		FallbackOnStatus: []int{http.StatusNotFound},
+		FallbackUpstream: fallbackURL,
+	}))
+
+	req, _ := http.NewRequest("GET", primary.URL+"/missing", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "fallback", w.Body.String())
+
+	req, _ = http.NewRequest("GET", primary.URL+"/present", nil)
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, "primary", w.Body.String())
+
+	// Can't replay a streamed body
+	req, _ = http.NewRequest("POST", primary.URL+"/missing", ioutil.NopCloser(strings.NewReader("data")))
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAbsoluteFormUpstream(t *testing.T) {
+	// Stands in for an upstream proxy
+	upstreamProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.RequestURI, "http://") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(req.RequestURI))
+	}))
+	defer upstreamProxy.Close()
+	proxyURL, _ := url.Parse(upstreamProxy.URL)
+
+	for _, absolute := range []bool{false, true} {
+		fwd := filters.Join(New(&Options{
+			IdleTimeout:          30 * time.Second,
+			Upstreams:            []*url.URL{proxyURL},
+			AbsoluteFormUpstream: absolute,
+		}))
+		req, _ := http.NewRequest("GET", "http://site.com/a%2Fb/c?q=1", nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		if !absolute {
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			continue
+		}
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "http://site.com/a%2Fb/c?q=1", w.Body.String())
+	}
+}
+
+func TestRouterTimeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-req.Context().Done():
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	slowURL, _ := url.Parse(slow.URL)
+	patient, patientURL := namedOrigin("patient")
+	defer patient.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Router: func(req *http.Request) *Route {
+			if strings.HasPrefix(req.URL.Path, "/short") {
+				return &Route{URL: slowURL, Timeout: 50 * time.Millisecond}
+			}
+			return &Route{URL: patientURL, Timeout: 5 * time.Second}
+		},
+	}))
+
+	req, _ := http.NewRequest("GET", "http://example.com/short", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	req, _ = http.NewRequest("GET", "http://example.com/long", nil)
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "patient", w.Body.String())
+}
+
+func TestRouterRetries(t *testing.T) {
+	u, _ := url.Parse("http://upstream.example.com")
+	attempts, failures := 0, 2
+	rt := mockRT{func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts <= failures {
+			return nil, errors.New("connection reset")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok")), Header: http.Header{}}, nil
+	}}
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:  30 * time.Second,
+		RoundTripper: rt,
+		Router: func(req *http.Request) *Route {
+			return &Route{URL: u, Retries: 2}
+		},
+	}))
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 3, attempts)
+
+	attempts, failures = 0, 3
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.NotEqual(t, http.StatusOK, w.Code, "should give up after the configured retries")
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetriesNonIdempotent(t *testing.T) {
+	u, _ := url.Parse("http://upstream.example.com")
+	attempts := 0
+	var failure error
+	rt := mockRT{func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, failure
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok")), Header: http.Header{}}, nil
+	}}
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:  30 * time.Second,
+		RoundTripper: rt,
+		Router: func(req *http.Request) *Route {
+			return &Route{URL: u, Retries: 2}
+		},
+	}))
+
+	tests := []struct {
+		method         string
+		idempotencyKey string
+		failure        error
+		expected       int
+	}{
+		// The upstream might have acted on it before the connection reset
+		{"POST", "", errors.New("connection reset"), 1},
+		{"PATCH", "", errors.New("connection reset"), 1},
+		{"POST", "abc", errors.New("connection reset"), 2},
+		{"PUT", "", errors.New("connection reset"), 2},
+		// It never got there
+		{"POST", "", &DialError{"upstream.example.com:80", errors.New("connection refused")}, 2},
+	}
+	for _, test := range tests {
+		attempts, failure = 0, test.failure
+		req, _ := http.NewRequest(test.method, "http://example.com/", nil)
+		if test.idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", test.idempotencyKey)
+		}
+		fwd.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, test.expected, attempts, "%v %v after %v", test.method, test.idempotencyKey, test.failure)
+	}
+}
+
+type upstreamKey struct{}
+
+func TestUpstreamContextKey(t *testing.T) {
+	primary := httptest.NewServer(http.NotFoundHandler())
+	defer primary.Close()
+	primaryURL, _ := url.Parse(primary.URL)
+	fallback, fallbackURL := namedOrigin("fallback")
+	defer fallback.Close()
+
+	var seen []interface{}
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		UpstreamContextKey: upstreamKey{},
+		OnResponse: func(resp *http.Response) {
+			seen = append(seen, resp.Request.Context().Value(upstreamKey{}))
+		},
+	}))
+	req, _ := http.NewRequest("GET", primary.URL, nil)
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, []interface{}{primaryURL.Host}, seen)
+
+	seen = nil
+	fwd = filters.Join(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		UpstreamContextKey: upstreamKey{},
+		FallbackOnStatus:   []int{http.StatusNotFound},
+		FallbackUpstream:   fallbackURL,
+		OnResponse: func(resp *http.Response) {
+			seen = append(seen, resp.Request.Context().Value(upstreamKey{}))
+		},
+	}))
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, "fallback", w.Body.String())
+	assert.Equal(t, []interface{}{fallbackURL.Host}, seen, "should expose the upstream that actually served the request")
+}
+
+func TestRouteBySNI(t *testing.T) {
+	defaultOrigin, defaultURL := namedOrigin("default")
+	defer defaultOrigin.Close()
+	a, aURL := namedOrigin("a")
+	defer a.Close()
+	b, bURL := namedOrigin("b")
+	defer b.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		RouteBySNI: map[string]*url.URL{
+			"a.example.com": aURL,
+			"b.example.com": bURL,
+		},
+	}))
+
+	tests := []struct {
+		tls      *tls.ConnectionState
+		expected string
+	}{
+		{&tls.ConnectionState{ServerName: "a.example.com"}, "a"},
+		{&tls.ConnectionState{ServerName: "B.example.com"}, "b"},
+		{&tls.ConnectionState{ServerName: "c.example.com"}, "default"},
+		{&tls.ConnectionState{}, "default"},
+		{nil, "default"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", defaultURL.String(), nil)
+		req.TLS = test.tls
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, test.expected, w.Body.String(), "wrong backend for SNI %q", SNI(req))
+	}
+}
+
+func TestRouteByPriority(t *testing.T) {
+	defaultOrigin, defaultURL := namedOrigin("default")
+	defer defaultOrigin.Close()
+	high, highURL := namedOrigin("high")
+	defer high.Close()
+	low, lowURL := namedOrigin("low")
+	defer low.Close()
+
+	routes := map[string]*url.URL{"high": highURL, "low": lowURL}
+	tests := []struct {
+		header   string
+		value    string
+		expected string
+	}{
+		{"Priority", "high", "high"},
+		{"Priority", " HIGH ", "high"},
+		{"Priority", "low", "low"},
+		{"Priority", "medium", "default"},
+		{"", "", "default"},
+	}
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:     30 * time.Second,
+		Upstreams:       []*url.URL{defaultURL},
+		RouteByPriority: routes,
+	}))
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, test.expected, w.Body.String(), "wrong backend for priority %q", test.value)
+	}
+
+	// With a custom header
+	fwd = filters.Join(New(&Options{
+		IdleTimeout:     30 * time.Second,
+		Upstreams:       []*url.URL{defaultURL},
+		RouteByPriority: routes,
+		PriorityHeader:  "X-Priority",
+	}))
+	for header, expected := range map[string]string{"X-Priority": "high", "Priority": "default"} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set(header, "high")
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, expected, w.Body.String(), "wrong backend with %v", header)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	u, _ := url.Parse("http://upstream.example.com")
+	attempts := 0
+	rt := mockRT{func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, errors.New("connection reset")
+	}}
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:  30 * time.Second,
+		RoundTripper: rt,
+		RetryBudget:  0.1,
+		Router: func(req *http.Request) *Route {
+			if req.URL.Path == "/once" {
+				return &Route{URL: u}
+			}
+			return &Route{URL: u, Retries: 4}
+		},
+	}))
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	var perRequest []int
+	for i := 0; i < 6; i++ {
+		attempts = 0
+		fwd.ServeHTTP(httptest.NewRecorder(), req)
+		perRequest = append(perRequest, attempts)
+	}
+	// 10 retries in reserve plus a tenth of a retry per request
+	assert.Equal(t, []int{5, 5, 3, 1, 1, 1}, perRequest)
+
+	// Requests on routes that don't retry earn retries too
+	once, _ := http.NewRequest("GET", "http://example.com/once", nil)
+	for i := 0; i < 6; i++ {
+		fwd.ServeHTTP(httptest.NewRecorder(), once)
+	}
+	attempts = 0
+	fwd.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestRetryResendsBody(t *testing.T) {
+	attempts := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts == 1 {
+			// Read some of the body and fail
+			req.Body.Read(make([]byte, 4))
+			panic(http.ErrAbortHandler)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	client, stop := proxiedClient(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Router: func(req *http.Request) *Route {
+			return &Route{URL: originURL, Retries: 1}
+		},
+	}))
+	defer stop()
+
+	req, _ := http.NewRequest("PUT", "http://example.com/upload", strings.NewReader("the whole body"))
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "the whole body", string(body))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestRetryIncompleteBody(t *testing.T) {
+	upstream, _ := url.Parse("http://upstream.example.com")
+	attempts := 0
+	rt := mockRT{func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok")), Header: http.Header{}}, nil
+	}}
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:  30 * time.Second,
+		RoundTripper: rt,
+		Router: func(req *http.Request) *Route {
+			return &Route{URL: upstream, Retries: 1}
+		},
+	}))
+
+	req, _ := http.NewRequest("PUT", "http://example.com/upload", ioutil.NopCloser(strings.NewReader("part")))
+	req.ContentLength = 10
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 0, attempts, "partial body should not be forwarded")
+}
+
+func TestRetryBodyTimeout(t *testing.T) {
+	attempts := make(chan struct{}, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts <- struct{}{}
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	client, stop := proxiedClient(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		RequestBodyTimeout: 100 * time.Millisecond,
+		Router: func(req *http.Request) *Route {
+			return &Route{URL: originURL, Retries: 1}
+		},
+	}))
+	defer stop()
+
+	body, stall := io.Pipe()
+	defer stall.Close()
+	go stall.Write([]byte("part of the body"))
+	req, _ := http.NewRequest("PUT", "http://example.com/upload", body)
+	req.ContentLength = 100
+	start := time.Now()
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	assert.True(t, time.Now().Sub(start) < time.Second, "buffering for retries should be bound by the body timeout")
+	assert.Len(t, attempts, 0, "partial body should not be forwarded")
+}
@@ -0,0 +1,233 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errFirstByteTimeout   = errors.New("Timed out waiting for the first byte of the response body")
+	errRequestBodyTimeout = errors.New("Timed out waiting for the request body")
+)
+
+// XRequestTimeout is the header clients can set the timeout of their
+// requests in, see Options.HonorClientTimeout
+const XRequestTimeout = "X-Request-Timeout"
+
+// timeoutFor is how long the exchange with the upstream can take, 0 if
+// there's no limit
+func (f *forwarder) timeoutFor(req *http.Request, route *Route) time.Duration {
+	var timeout time.Duration
+	if route != nil {
+		timeout = route.Timeout
+	}
+	if timeout <= 0 {
+		timeout = f.DefaultRequestTimeout
+	}
+	if f.HonorClientTimeout {
+		if d, ok := clientTimeout(req.Header); ok {
+			limit := timeout
+			if f.MaxClientTimeout > 0 {
+				limit = f.MaxClientTimeout
+			}
+			if limit <= 0 || d < limit {
+				return d
+			}
+			return limit
+		}
+	}
+	return timeout
+}
+
+// clientTimeout parses the timeout the client asked for, if any
+func clientTimeout(header http.Header) (time.Duration, bool) {
+	if v := header.Get(XRequestTimeout); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			return positive(time.Duration(secs * float64(time.Second)))
+		}
+		if d, err := time.ParseDuration(v); err == nil {
+			return positive(d)
+		}
+	}
+	if v := header.Get("Grpc-Timeout"); v != "" {
+		return parseGRPCTimeout(v)
+	}
+	return 0, false
+}
+
+// grpcTimeoutUnits are the units of grpc-timeout values
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseGRPCTimeout parses a grpc-timeout value, up to 8 digits followed by a
+// unit, as in "100m" for 100 milliseconds
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	unit, found := grpcTimeoutUnits[v[len(v)-1]]
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return positive(time.Duration(n) * unit)
+}
+
+func positive(d time.Duration) (time.Duration, bool) {
+	return d, d > 0
+}
+
+// errHeaderReadTimeout is a net.Error, so that the error handler responds 504
+// to it like to other timeouts
+var errHeaderReadTimeout error = headerReadTimeoutError{}
+
+type headerReadTimeoutError struct{}
+
+func (headerReadTimeoutError) Error() string   { return "Timed out reading the response headers" }
+func (headerReadTimeoutError) Timeout() bool   { return true }
+func (headerReadTimeoutError) Temporary() bool { return true }
+
+// headerTimer enforces the HeaderReadTimeout of a round trip by canceling it
+type headerTimer struct {
+	mx      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+	expired bool
+}
+
+// withHeaderReadTimeout returns a copy of outReq that's canceled if the
+// response headers don't arrive within timeout of the request being written
+func withHeaderReadTimeout(outReq *http.Request, timeout time.Duration) (*http.Request, *headerTimer) {
+	// Only canceled when the timer expires, the context of the request cleans
+	// it up otherwise
+	ctx, cancel := context.WithCancel(outReq.Context())
+	t := &headerTimer{}
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mx.Lock()
+			defer t.mx.Unlock()
+			if t.stopped || t.timer != nil {
+				return
+			}
+			t.timer = time.AfterFunc(timeout, func() {
+				t.mx.Lock()
+				expire := !t.stopped
+				t.expired = expire
+				t.mx.Unlock()
+				if expire {
+					cancel()
+				}
+			})
+		},
+	}
+	return outReq.WithContext(httptrace.WithClientTrace(ctx, trace)), t
+}
+
+// stop stops the timer once the round trip is over, telling whether it had
+// expired
+func (t *headerTimer) stop() bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return t.expired
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+// prefixedBody is a response body with some bytes already read from it
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// waitForFirstByte waits until the first byte of body is available or the
+// deadline passes. It returns a body that still yields all the bytes.
+func waitForFirstByte(body io.ReadCloser, deadline time.Time) (io.ReadCloser, error) {
+	buf := make([]byte, 512)
+	result := make(chan readResult, 1)
+	go func() {
+		n, err := body.Read(buf)
+		result <- readResult{n, err}
+	}()
+
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case r := <-result:
+		if r.err != nil && r.err != io.EOF {
+			return nil, r.err
+		}
+		reader := io.MultiReader(bytes.NewReader(buf[:r.n]), body)
+		if r.err == io.EOF {
+			reader = bytes.NewReader(buf[:r.n])
+		}
+		return &prefixedBody{reader, body}, nil
+	case <-timer.C:
+		// The caller closes the body, which unblocks the pending read
+		return nil, errFirstByteTimeout
+	}
+}
+
+// timeoutBody is a request body that fails reads when the client doesn't send
+// anything for timeout, enforced with read deadlines on the client connection
+type timeoutBody struct {
+	io.ReadCloser
+	rc       *http.ResponseController
+	timeout  time.Duration
+	timedOut int32
+}
+
+// withBodyTimeout sets a timeoutBody on outReq if it has a body and the
+// ResponseWriter supports read deadlines, returning nil otherwise.
+func withBodyTimeout(w http.ResponseWriter, outReq *http.Request, timeout time.Duration) *timeoutBody {
+	if outReq.Body == nil || outReq.Body == http.NoBody {
+		return nil
+	}
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		log.Debugf("Unable to enforce the request body timeout: %v", err)
+		return nil
+	}
+	body := &timeoutBody{ReadCloser: outReq.Body, rc: rc, timeout: timeout}
+	outReq.Body = body
+	return body
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	b.rc.SetReadDeadline(time.Now().Add(b.timeout))
+	n, err := b.ReadCloser.Read(p)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		atomic.StoreInt32(&b.timedOut, 1)
+	} else if err == io.EOF {
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+func (b *timeoutBody) expired() bool {
+	return atomic.LoadInt32(&b.timedOut) == 1
+}
@@ -0,0 +1,299 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestFirstByteTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		if req.URL.Path == "/stall" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.Write([]byte("body"))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:      30 * time.Second,
+		FirstByteTimeout: 100 * time.Millisecond,
+	}))
+
+	req, _ := http.NewRequest("GET", origin.URL+"/stall", nil)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.True(t, time.Now().Sub(start) < 400*time.Millisecond, "should give up after the first byte timeout")
+
+	req, _ = http.NewRequest("GET", origin.URL+"/fast", nil)
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "body", w.Body.String())
+}
+
+func TestHeaderReadTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.URL.Path == "/trickle" {
+					// The first line comes right away, the rest slowly
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\n")
+					for i := 0; i < 10; i++ {
+						time.Sleep(100 * time.Millisecond)
+						if _, err := fmt.Fprintf(conn, "X-Header-%d: %d\r\n", i, i); err != nil {
+							return
+						}
+					}
+					io.WriteString(conn, "Content-Length: 4\r\n\r\nbody")
+					return
+				}
+				// Prompt headers, slow body
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\n")
+				time.Sleep(500 * time.Millisecond)
+				io.WriteString(conn, "body")
+			}()
+		}
+	}()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:       30 * time.Second,
+		HeaderReadTimeout: 300 * time.Millisecond,
+	}))
+
+	req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/trickle", nil)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.True(t, time.Since(start) < 800*time.Millisecond, "should give up after the header read timeout")
+
+	req, _ = http.NewRequest("GET", "http://"+l.Addr().String()+"/slowbody", nil)
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "body", w.Body.String(), "the body should not be bound by the header read timeout")
+}
+
+func TestRequestBodyTimeout(t *testing.T) {
+	originErr := make(chan error, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, err := ioutil.ReadAll(req.Body)
+		originErr <- err
+	}))
+	defer origin.Close()
+
+	client, closeProxy := proxiedClient(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		RequestBodyTimeout: 100 * time.Millisecond,
+	}))
+	defer closeProxy()
+
+	body, stall := io.Pipe()
+	defer stall.Close()
+	go stall.Write([]byte("part of the body"))
+	req, _ := http.NewRequest("POST", origin.URL, body)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	assert.True(t, time.Now().Sub(start) < time.Second, "should time out after the body timeout")
+
+	select {
+	case err := <-originErr:
+		assert.Error(t, err, "upstream connection should have been dropped mid-body")
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "upstream still waiting for the body")
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// Accepts connections but never answers the TLS handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	u, _ := url.Parse("https://" + l.Addr().String())
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:         30 * time.Second,
+		Upstreams:           []*url.URL{u},
+		TLSHandshakeTimeout: 50 * time.Millisecond,
+	}))
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.True(t, time.Since(start) < 5*time.Second, "should have given up on the handshake early")
+}
+
+func TestHonorClientTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-req.Context().Done():
+		}
+		w.Write([]byte("done"))
+	}))
+	defer origin.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		HonorClientTimeout: true,
+		MaxClientTimeout:   time.Second,
+	}))
+
+	tests := []struct {
+		header   string
+		value    string
+		expected int
+	}{
+		{"", "", http.StatusOK},
+		{XRequestTimeout, "0.05", http.StatusGatewayTimeout},
+		{XRequestTimeout, "50ms", http.StatusGatewayTimeout},
+		{XRequestTimeout, "5", http.StatusOK},
+		{XRequestTimeout, "bogus", http.StatusOK},
+		{"Grpc-Timeout", "50m", http.StatusGatewayTimeout},
+		{"Grpc-Timeout", "1S", http.StatusOK},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, test.expected, w.Code, "%v: %v", test.header, test.value)
+	}
+
+	// Capped by MaxClientTimeout
+	assert.Equal(t, 50*time.Millisecond, (&forwarder{Options: &Options{HonorClientTimeout: true, MaxClientTimeout: 50 * time.Millisecond}}).timeoutFor(
+		&http.Request{Header: http.Header{XRequestTimeout: {"60"}}}, &Route{Timeout: time.Second}))
+
+	// Without MaxClientTimeout, clients can only shorten the timeout
+	f := &forwarder{Options: &Options{HonorClientTimeout: true, DefaultRequestTimeout: 2 * time.Second}}
+	for _, test := range []struct {
+		value    string
+		route    *Route
+		expected time.Duration
+	}{
+		{"60", &Route{Timeout: time.Second}, time.Second},
+		{"0.5", &Route{Timeout: time.Second}, 500 * time.Millisecond},
+		{"60", nil, 2 * time.Second},
+		{"0.5", nil, 500 * time.Millisecond},
+		{"bogus", &Route{Timeout: time.Second}, time.Second},
+	} {
+		assert.Equal(t, test.expected, f.timeoutFor(&http.Request{Header: http.Header{XRequestTimeout: {test.value}}}, test.route), test.value)
+	}
+	f.DefaultRequestTimeout = 0
+	assert.Equal(t, time.Minute, f.timeoutFor(&http.Request{Header: http.Header{XRequestTimeout: {"60"}}}, nil), "nothing to shorten")
+}
+
+func TestDefaultRequestTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(10 * time.Second):
+		case <-req.Context().Done():
+		}
+		w.Write([]byte("done"))
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:           30 * time.Second,
+		HonorClientTimeout:    true,
+		DefaultRequestTimeout: 100 * time.Millisecond,
+		Router: func(req *http.Request) *Route {
+			if req.URL.Path == "/routed" {
+				return &Route{URL: originURL, Timeout: 300 * time.Millisecond}
+			}
+			return nil
+		},
+	}))
+
+	tests := []struct {
+		path     string
+		timeout  string
+		expected time.Duration
+	}{
+		{"/", "", 100 * time.Millisecond},
+		{"/routed", "", 300 * time.Millisecond},
+		// Clients can only shorten the timeout
+		{"/", "0.3", 100 * time.Millisecond},
+		{"/routed", "0.15", 150 * time.Millisecond},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", origin.URL+test.path, nil)
+		if test.timeout != "" {
+			req.Header.Set(XRequestTimeout, test.timeout)
+		}
+		w := httptest.NewRecorder()
+		start := time.Now()
+		fwd.ServeHTTP(w, req)
+		elapsed := time.Since(start)
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code, "%v %v", test.path, test.timeout)
+		assert.True(t, elapsed >= test.expected && elapsed < test.expected+time.Second, "%v %v should have been cut off after %v, not %v", test.path, test.timeout, test.expected, elapsed)
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	for v, expected := range map[string]time.Duration{
+		"1H":        time.Hour,
+		"2M":        2 * time.Minute,
+		"100m":      100 * time.Millisecond,
+		"10u":       10 * time.Microsecond,
+		"99999999n": 99999999 * time.Nanosecond,
+	} {
+		d, ok := parseGRPCTimeout(v)
+		assert.True(t, ok, v)
+		assert.Equal(t, expected, d, v)
+	}
+	for _, v := range []string{"", "5", "5x", "m", "123456789S", "-5S", "0S"} {
+		_, ok := parseGRPCTimeout(v)
+		assert.False(t, ok, v)
+	}
+}
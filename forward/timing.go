@@ -0,0 +1,70 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings tell where the time of a round trip to the upstream went
+type Timings struct {
+	// QueueWait is the time spent waiting for a connection to the upstream,
+	// be it for a slot under MaxUpstreamConns, for an idle connection or for
+	// dialing a new one.
+	QueueWait time.Duration
+	// Upstream is the time from getting a connection to receiving the first
+	// byte of the response.
+	Upstream time.Duration
+}
+
+// timingTrace collects Timings through an httptrace.ClientTrace
+type timingTrace struct {
+	mx        sync.Mutex
+	getConn   time.Time
+	gotConn   time.Time
+	firstByte time.Time
+}
+
+// withTimingTrace returns a copy of outReq that records its timings
+func withTimingTrace(outReq *http.Request) (*http.Request, *timingTrace) {
+	t := &timingTrace{}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mark(&t.getConn)
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			t.mark(&t.gotConn)
+		},
+		GotFirstResponseByte: func() {
+			t.mark(&t.firstByte)
+		},
+	}
+	return outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), trace)), t
+}
+
+func (t *timingTrace) mark(at *time.Time) {
+	t.mx.Lock()
+	*at = time.Now()
+	t.mx.Unlock()
+}
+
+func (t *timingTrace) timings() Timings {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	var timings Timings
+	if !t.getConn.IsZero() && !t.gotConn.IsZero() {
+		timings.QueueWait = t.gotConn.Sub(t.getConn)
+	}
+	if !t.gotConn.IsZero() && !t.firstByte.IsZero() {
+		timings.Upstream = t.firstByte.Sub(t.gotConn)
+	}
+	return timings
+}
+
+// serverTiming formats timings as a Server-Timing header value
+func serverTiming(timings Timings) string {
+	return fmt.Sprintf("queue;dur=%.1f, upstream;dur=%.1f",
+		timings.QueueWait.Seconds()*1000, timings.Upstream.Seconds()*1000)
+}
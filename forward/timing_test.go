@@ -0,0 +1,57 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestTimingsUnderSaturation(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer origin.Close()
+
+	var mx sync.Mutex
+	var recorded []Timings
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:      30 * time.Second,
+		MaxUpstreamConns: 1,
+		OnTimings: func(req *http.Request, timings Timings) {
+			mx.Lock()
+			recorded = append(recorded, timings)
+			mx.Unlock()
+		},
+		ServerTimingHeader: true,
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", origin.URL, nil)
+			w := httptest.NewRecorder()
+			fwd.ServeHTTP(w, req)
+			assert.True(t, strings.HasPrefix(w.Header().Get("Server-Timing"), "queue;dur="), w.Header().Get("Server-Timing"))
+		}()
+	}
+	wg.Wait()
+
+	if !assert.Len(t, recorded, 2) {
+		return
+	}
+	first, second := recorded[0], recorded[1]
+	for _, timings := range recorded {
+		assert.True(t, timings.Upstream >= 90*time.Millisecond, "upstream time should cover the origin's latency: %v", timings.Upstream)
+	}
+	assert.True(t, first.QueueWait < 50*time.Millisecond, "first request shouldn't wait: %v", first.QueueWait)
+	assert.True(t, second.QueueWait >= 90*time.Millisecond, "second request should wait for the connection: %v", second.QueueWait)
+}
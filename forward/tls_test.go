@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestMinUpstreamTLSVersion(t *testing.T) {
+	offered := make(chan []uint16, 1)
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	origin.TLS = &tls.Config{
+		MinVersion: tls.VersionTLS10,
+		MaxVersion: tls.VersionTLS10,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			offered <- hello.SupportedVersions
+			return nil, nil
+		},
+	}
+	origin.StartTLS()
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Upstreams:   []*url.URL{u},
+	}))
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.NotEqual(t, http.StatusOK, w.Code, "TLS 1.0 upstream should have been rejected")
+	assert.NotContains(t, w.Body.String(), "hello")
+	versions := <-offered
+	assert.NotContains(t, versions, uint16(tls.VersionTLS10))
+	assert.NotContains(t, versions, uint16(tls.VersionTLS11))
+}
+
+func TestUpstreamTLSState(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	origin.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	origin.StartTLS()
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+
+	states := make(chan *tls.ConnectionState, 1)
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:        30 * time.Second,
+		Upstreams:          []*url.URL{u},
+		UpstreamRootCAs:    roots,
+		UpstreamTLSHeaders: true,
+		OnResponse: func(resp *http.Response) {
+			states <- resp.TLS
+		},
+	}))
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, "hello", w.Body.String())
+
+	state := <-states
+	if assert.NotNil(t, state) {
+		assert.EqualValues(t, tls.VersionTLS12, state.Version)
+		if assert.NotEmpty(t, state.PeerCertificates) {
+			assert.Equal(t, origin.Certificate().Raw, state.PeerCertificates[0].Raw)
+		}
+		assert.Equal(t, tls.CipherSuiteName(state.CipherSuite), w.Header().Get(XUpstreamTLSCipher))
+	}
+	assert.Equal(t, "TLS 1.2", w.Header().Get(XUpstreamTLSVersion))
+
+	// Also captured for transports that don't fill it in
+	fwd = filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		RoundTripper: mockRT{func(req *http.Request) (*http.Response, error) {
+			resp, err := origin.Client().Transport.RoundTrip(req)
+			if resp != nil {
+				resp.TLS = nil
+			}
+			return resp, err
+		}},
+		Upstreams: []*url.URL{u},
+		OnResponse: func(resp *http.Response) {
+			states <- resp.TLS
+		},
+	}))
+	req, _ = http.NewRequest("GET", "http://example.com", nil)
+	w = httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, "hello", w.Body.String())
+	if state := <-states; assert.NotNil(t, state) {
+		assert.EqualValues(t, tls.VersionTLS12, state.Version)
+	}
+	assert.Empty(t, w.Header().Get(XUpstreamTLSVersion), "headers should only be added when enabled")
+}
@@ -0,0 +1,28 @@
+package forward
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+)
+
+// sampleTrace decides whether to dump the request and its response, as per
+// the TraceSampleRate
+func (f *forwarder) sampleTrace() bool {
+	return f.TraceSampleRate >= 1 || (f.TraceSampleRate > 0 && rand.Float64() < f.TraceSampleRate)
+}
+
+// dumpSampledRequest logs the headers of the request as received and as
+// forwarded
+func dumpSampledRequest(req *http.Request, outReq *http.Request) {
+	reqStr, _ := httputil.DumpRequest(req, false)
+	outReqStr, _ := httputil.DumpRequest(outReq, false)
+	log.Debugf("Sampled request from %v:\n%s\nForwarded as:\n%s", req.RemoteAddr, reqStr, outReqStr)
+}
+
+// dumpSampledResponse logs the headers of the upstream's response to a
+// sampled request
+func dumpSampledResponse(req *http.Request, resp *http.Response) {
+	respStr, _ := httputil.DumpResponse(resp, false)
+	log.Debugf("Sampled response to %v:\n%s", req.RemoteAddr, respStr)
+}
@@ -0,0 +1,52 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestTraceSampleRate(t *testing.T) {
+	var errorOut, debugOut syncBuffer
+	reset := golog.SetOutputs(&errorOut, &debugOut)
+	defer reset()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:     30 * time.Second,
+		TraceSampleRate: 0.2,
+		RoundTripper: mockRT{func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"X-Sampled-Response": {"yes"}},
+				Body:       ioutil.NopCloser(strings.NewReader("hello")),
+				Request:    req,
+			}, nil
+		}},
+	}))
+	const requests = 1000
+	for i := 0; i < requests; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, "hello", w.Body.String(), "sampled or not, the body should be forwarded")
+	}
+
+	out := debugOut.String()
+	sampled := countLines(out, "Sampled request from")
+	assert.True(t, sampled > requests/10 && sampled < requests*3/10, "about a fifth of the requests should have been sampled, not %d", sampled)
+	assert.Equal(t, sampled, countLines(out, "Sampled response to"))
+	assert.Equal(t, sampled, countLines(out, "X-Sampled-Response: yes"))
+}
+
+func TestSampleTrace(t *testing.T) {
+	assert.False(t, (&forwarder{Options: &Options{}}).sampleTrace())
+	assert.True(t, (&forwarder{Options: &Options{TraceSampleRate: 1}}).sampleTrace())
+}
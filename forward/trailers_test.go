@@ -0,0 +1,108 @@
+package forward
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+// proxiedClient returns a client that sends all its requests through a proxy
+// running the given filter
+func proxiedClient(filter filters.Filter) (*http.Client, func()) {
+	proxy := httptest.NewServer(filters.Join(filter))
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	return &http.Client{Transport: transport}, func() {
+		transport.CloseIdleConnections()
+		proxy.Close()
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", "application/grpc-web")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", req.Trailer.Get("X-Checksum"))
+	}))
+	defer origin.Close()
+
+	client, closeProxy := proxiedClient(New(&Options{IdleTimeout: 30 * time.Second}))
+	defer closeProxy()
+
+	// Wrap the reader so that the length is unknown and the body gets chunked
+	body := ioutil.NopCloser(strings.NewReader("grpc payload"))
+	req, _ := http.NewRequest("POST", origin.URL, body)
+	req.Trailer = http.Header{"X-Checksum": []string{"abc123"}}
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	assert.Contains(t, resp.Trailer, "Grpc-Status", "trailers should have been announced")
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "grpc payload", string(b))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "abc123", resp.Trailer.Get("Grpc-Message"), "request trailer should have reached the origin")
+}
+
+func TestDisableRequestTrailers(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+		w.Write([]byte(req.Trailer.Get("X-Checksum")))
+	}))
+	defer origin.Close()
+
+	for _, disable := range []bool{false, true} {
+		client, closeProxy := proxiedClient(New(&Options{IdleTimeout: 30 * time.Second, DisableRequestTrailers: disable}))
+		req, _ := http.NewRequest("POST", origin.URL, ioutil.NopCloser(strings.NewReader("payload ")))
+		req.Trailer = http.Header{"X-Checksum": []string{"abc123"}}
+		resp, err := client.Do(req)
+		if assert.NoError(t, err) {
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if disable {
+				assert.Equal(t, "payload ", string(b), "request trailer shouldn't have reached the origin")
+			} else {
+				assert.Equal(t, "payload abc123", string(b))
+			}
+		}
+		closeProxy()
+	}
+}
+
+// BenchmarkCloneRequest compares the cost of cloning requests with and without
+// forwarding their trailers, which are shared with the outbound request rather
+// than read ahead of time, so they don't add to it.
+func BenchmarkCloneRequest(b *testing.B) {
+	for _, disable := range []bool{false, true} {
+		b.Run(fmt.Sprintf("DisableRequestTrailers=%v", disable), func(b *testing.B) {
+			f := New(&Options{IdleTimeout: 30 * time.Second, DisableRequestTrailers: disable}).(*forwarder)
+			defer f.Close()
+			req, _ := http.NewRequest("POST", "http://example.com/upload", ioutil.NopCloser(strings.NewReader("payload")))
+			req.TransferEncoding = []string{"chunked"}
+			req.Trailer = http.Header{"X-Checksum": []string{"abc123"}}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.cloneRequest(req, nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/ops"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+// tunnelUpgrade completes a protocol switch, like a WebSocket handshake, the
+// upstream agreed to with a 101 response: it sends the response on to the
+// client then copies bytes both ways between the client and the upstream
+// until either side is done.
+func (f *forwarder) tunnelUpgrade(op ops.Op, w http.ResponseWriter, req *http.Request, response *http.Response, usage *quotaUsage) error {
+	upstream, ok := response.Body.(io.ReadWriteCloser)
+	if !ok || !isUpgrade(req.Header) {
+		// Either the transport can't hand over the connection or the client
+		// never asked to switch
+		response.Body.Close()
+		return f.serveError(op, w, req, http.StatusBadGateway, fmt.Sprintf("Unexpected switch to %q", response.Header.Get("Upgrade")))
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		return f.serveError(op, w, req, http.StatusBadGateway, "Unable to switch protocols on the client connection")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return f.serveError(op, w, req, http.StatusBadGateway, errors.New("Unable to hijack client connection: %v", err))
+	}
+	defer conn.Close()
+	defer upstream.Close()
+
+	header := make(http.Header)
+	copyHeadersForForwarding(header, response.Header)
+	// Hop-by-hop like on the request, but they're what the client needs to
+	// know that the protocol switched
+	header.Set("Connection", "Upgrade")
+	header["Upgrade"] = append([]string(nil), response.Header["Upgrade"]...)
+	switched := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	if err = switched.Write(brw); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		log.Error(op.FailIf(errors.New("Unable to write 101 response to client: %v", err)))
+		return filters.Stop()
+	}
+
+	// Whatever the client sent after its request is already in brw
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstream, brw)
+		done <- err
+	}()
+	go func() {
+		written, err := io.Copy(conn, upstream)
+		if usage != nil {
+			usage.add(written)
+		}
+		done <- err
+	}()
+	// Closing both ends the other direction
+	if err = <-done; err != nil {
+		log.Debugf("Upgraded connection to %v ended: %v", req.Host, err)
+	}
+	return filters.Stop()
+}
@@ -0,0 +1,147 @@
+package forward
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultUpstreamCooldown = 10 * time.Second
+
+// upstream is a backend the forwarder balances requests across. It's
+// considered down until downUntil (in Unix nanoseconds) after a failure, and
+// while the HealthCheck finds it unhealthy.
+type upstream struct {
+	url       *url.URL
+	weight    int
+	downUntil int64
+	unhealthy int32
+
+	// Only accessed with the pool's lock held
+	currentWeight int
+
+	// Only accessed by the health checker
+	passes   int
+	failures int
+
+	outliers outlierStats
+}
+
+func (u *upstream) isUp(now time.Time) bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0 && atomic.LoadInt64(&u.downUntil) <= now.UnixNano()
+}
+
+func (u *upstream) markDown(cooldown time.Duration) {
+	atomic.StoreInt64(&u.downUntil, time.Now().Add(cooldown).UnixNano())
+}
+
+func (u *upstream) markUp() {
+	atomic.StoreInt64(&u.downUntil, 0)
+}
+
+// upstreamPool balances requests across the healthy upstreams using smooth
+// weighted round robin, which spreads the picks of heavier upstreams evenly
+// instead of sending them in bursts. With equal weights it's plain round robin.
+type upstreamPool struct {
+	upstreams []*upstream
+	cooldown  time.Duration
+	mx        sync.Mutex
+
+	// How often the unhealthy upstreams get another chance, if checking
+	// their health
+	checkInterval time.Duration
+
+	// Only set when using consistent hashing
+	ring *hashRing
+}
+
+// newUpstreamPool builds a pool with the given urls, each with a weight of 1,
+// plus the weighted ones, keyed by URL.
+func newUpstreamPool(urls []*url.URL, weighted map[string]int, cooldown time.Duration) *upstreamPool {
+	if cooldown <= 0 {
+		cooldown = defaultUpstreamCooldown
+	}
+	p := &upstreamPool{cooldown: cooldown}
+	for _, u := range urls {
+		p.upstreams = append(p.upstreams, &upstream{url: u, weight: 1})
+	}
+
+	// Sort them so that the order of the picks is deterministic
+	keys := make([]string, 0, len(weighted))
+	for k := range weighted {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		u, err := url.Parse(k)
+		if err != nil || u.Host == "" {
+			log.Errorf("Ignoring invalid upstream %q: %v", k, err)
+			continue
+		}
+		if weighted[k] <= 0 {
+			log.Errorf("Ignoring upstream %v with non positive weight %d", k, weighted[k])
+			continue
+		}
+		p.upstreams = append(p.upstreams, &upstream{url: u, weight: weighted[k]})
+	}
+	return p
+}
+
+// pick returns the next healthy upstream. If all of them are down, it returns
+// nil along with the time left until the soonest one is expected to recover.
+func (p *upstreamPool) pick() (*upstream, time.Duration) {
+	now := time.Now()
+	p.mx.Lock()
+	var best *upstream
+	total := 0
+	for _, u := range p.upstreams {
+		if !u.isUp(now) {
+			continue
+		}
+		u.currentWeight += u.weight
+		total += u.weight
+		if best == nil || u.currentWeight > best.currentWeight {
+			best = u
+		}
+	}
+	if best != nil {
+		best.currentWeight -= total
+	}
+	p.mx.Unlock()
+	if best != nil {
+		return best, 0
+	}
+	return nil, p.untilRecovery(now)
+}
+
+// pickFor returns the healthy upstream that the key maps to on the hash ring.
+// If all of them are down, it returns nil along with the time left until the
+// soonest one is expected to recover.
+func (p *upstreamPool) pickFor(key string) (*upstream, time.Duration) {
+	now := time.Now()
+	u := p.ring.lookup(key, func(u *upstream) bool {
+		return u.isUp(now)
+	})
+	if u != nil {
+		return u, 0
+	}
+	return nil, p.untilRecovery(now)
+}
+
+func (p *upstreamPool) untilRecovery(now time.Time) time.Duration {
+	soonest := int64(-1)
+	for _, u := range p.upstreams {
+		downUntil := atomic.LoadInt64(&u.downUntil)
+		if atomic.LoadInt32(&u.unhealthy) == 1 {
+			if next := now.Add(p.checkInterval).UnixNano(); next > downUntil {
+				downUntil = next
+			}
+		}
+		if soonest == -1 || downUntil < soonest {
+			soonest = downUntil
+		}
+	}
+	return time.Duration(soonest - now.UnixNano())
+}
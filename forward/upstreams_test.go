@@ -0,0 +1,105 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestAllUpstreamsDown(t *testing.T) {
+	var upstreams []*url.URL
+	for i := 0; i < 2; i++ {
+		origin, u := namedOrigin("origin")
+		// Close right away so that dialing it fails
+		origin.Close()
+		upstreams = append(upstreams, u)
+	}
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout:      30 * time.Second,
+		Upstreams:        upstreams,
+		UpstreamCooldown: 30 * time.Second,
+	}))
+
+	// Each upstream fails once and is marked as down
+	for i := 0; i < len(upstreams); i++ {
+		req, _ := http.NewRequest("GET", "http://site.com/", nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "http://site.com/", nil)
+	w := httptest.NewRecorder()
+	fwd.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "should fail fast when all upstreams are down")
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if assert.NoError(t, err, "should have a numeric Retry-After") {
+		assert.True(t, retryAfter > 0 && retryAfter <= 30, "Retry-After should be within the cooldown, got %d", retryAfter)
+	}
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	a, aURL := namedOrigin("a")
+	defer a.Close()
+	b, bURL := namedOrigin("b")
+	defer b.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Upstreams:   []*url.URL{aURL, bURL},
+	}))
+
+	served := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", "http://site.com/", nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		served[w.Body.String()]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, served)
+}
+
+func TestWeightedUpstreams(t *testing.T) {
+	big, bigURL := namedOrigin("big")
+	defer big.Close()
+	small, smallURL := namedOrigin("small")
+	defer small.Close()
+
+	fwd := filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		WeightedUpstreams: map[string]int{
+			bigURL.String():   3,
+			smallURL.String(): 1,
+		},
+	}))
+
+	served := make(map[string]int)
+	smallInRound := 0
+	for i := 0; i < 400; i++ {
+		req, _ := http.NewRequest("GET", "http://site.com/", nil)
+		w := httptest.NewRecorder()
+		fwd.ServeHTTP(w, req)
+		served[w.Body.String()]++
+		if i == 0 {
+			assert.Equal(t, "big", w.Body.String(), "heaviest upstream should be picked first")
+		}
+		if w.Body.String() == "small" {
+			smallInRound++
+		}
+		if i%4 == 3 {
+			// Where exactly small lands within a round depends on the order of
+			// the upstreams, but it's never picked twice in a row
+			assert.Equal(t, 1, smallInRound, "picks should be spread out smoothly")
+			smallInRound = 0
+		}
+	}
+	assert.Equal(t, map[string]int{"big": 300, "small": 100}, served)
+}
@@ -0,0 +1,63 @@
+package forward
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// The headers UpstreamTLSHeaders adds to responses
+const (
+	XUpstreamTLSVersion = "X-Upstream-TLS-Version"
+	XUpstreamTLSCipher  = "X-Upstream-TLS-Cipher"
+)
+
+// tlsCapture records the state of the TLS connection a request was sent on
+type tlsCapture struct {
+	mx    sync.Mutex
+	state *tls.ConnectionState
+}
+
+// withTLSCapture returns a copy of outReq that records the state of the TLS
+// connection it gets, if any
+func withTLSCapture(outReq *http.Request) (*http.Request, *tlsCapture) {
+	c := &tlsCapture{}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn, ok := info.Conn.(interface{ ConnectionState() tls.ConnectionState })
+			if !ok {
+				c.set(nil)
+				return
+			}
+			state := conn.ConnectionState()
+			c.set(&state)
+		},
+	}
+	return outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), trace)), c
+}
+
+func (c *tlsCapture) set(state *tls.ConnectionState) {
+	c.mx.Lock()
+	c.state = state
+	c.mx.Unlock()
+}
+
+func (c *tlsCapture) connectionState() *tls.ConnectionState {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.state
+}
+
+// exposeUpstreamTLS makes the state of the TLS connection to the upstream
+// available as resp.TLS, which custom transports may leave out, and adds the
+// UpstreamTLSHeaders if enabled.
+func (f *forwarder) exposeUpstreamTLS(resp *http.Response, capture *tlsCapture) {
+	if resp.TLS == nil && capture != nil {
+		resp.TLS = capture.connectionState()
+	}
+	if f.UpstreamTLSHeaders && resp.TLS != nil {
+		resp.Header.Set(XUpstreamTLSVersion, tls.VersionName(resp.TLS.Version))
+		resp.Header.Set(XUpstreamTLSCipher, tls.CipherSuiteName(resp.TLS.CipherSuite))
+	}
+}
@@ -3,6 +3,7 @@ package forward
 import (
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 // cloneURL provides update safe copy by avoiding shallow copying User field
@@ -14,8 +15,20 @@ func cloneURL(i *url.URL) *url.URL {
 	return &out
 }
 
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	out := make(http.Header, len(h))
+	for k, vv := range h {
+		out[k] = append([]string(nil), vv...)
+	}
+	return out
+}
+
 // copyHeadersForForwarding will copy the headers but filter those that shouldn't be
-// forwarded
+// forwarded. Values are added one by one, so headers with multiple values
+// (e.g. Set-Cookie) keep being sent as separate lines, in their original order.
 func copyHeadersForForwarding(dst, src http.Header) {
 	var extraHopByHopHeaders []string
 	for k, vv := range src {
@@ -28,11 +41,23 @@ func copyHeadersForForwarding(dst, src http.Header) {
 		case "Keep-Alive":
 		case "Proxy-Authenticate":
 		case "Proxy-Authorization":
-		case "TE":
+		case "Te":
+			// "trailers" is the only value that makes sense end to end, and
+			// gRPC requires it to get through
+			for _, v := range vv {
+				if strings.EqualFold(strings.TrimSpace(v), "trailers") {
+					dst.Add(k, v)
+				}
+			}
 		case "Trailers":
 		case "Transfer-Encoding":
 		case "Upgrade":
 		default:
+			if strings.HasPrefix(k, ":") {
+				// HTTP/2 pseudo-headers only exist on the connection they came
+				// in on and aren't valid downstream or in HTTP/1.1
+				continue
+			}
 			if !contains(k, extraHopByHopHeaders) {
 				for _, v := range vv {
 					dst.Add(k, v)
@@ -42,6 +67,61 @@ func copyHeadersForForwarding(dst, src http.Header) {
 	}
 }
 
+// isUpgrade tells whether the headers ask to switch protocols, e.g. for a
+// WebSocket handshake
+func isUpgrade(header http.Header) bool {
+	if header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dropHeaders removes the given headers, regardless of their case
+func dropHeaders(header http.Header, keys []string) {
+	for _, k := range keys {
+		header.Del(k)
+	}
+}
+
+// echoHeaders copies the given headers from src into dst, if src has them
+func echoHeaders(dst, src http.Header, keys []string) {
+	for _, k := range keys {
+		if vv := src.Values(k); len(vv) > 0 {
+			dst[http.CanonicalHeaderKey(k)] = append([]string(nil), vv...)
+		}
+	}
+}
+
+// mandatoryHeaders are kept by keepHeaders regardless, since the request
+// can't be understood without them
+var mandatoryHeaders = []string{"Host", "Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding"}
+
+// keepHeaders removes all headers but the given ones and the mandatory ones,
+// regardless of their case
+func keepHeaders(header http.Header, keys []string) {
+	for k := range header {
+		if !contains(k, mandatoryHeaders) && !containsFold(k, keys) {
+			delete(header, k)
+		}
+	}
+}
+
+func containsFold(k string, s []string) bool {
+	for _, h := range s {
+		if strings.EqualFold(k, h) {
+			return true
+		}
+	}
+	return false
+}
+
 func contains(k string, s []string) bool {
 	for _, h := range s {
 		if k == h {
@@ -50,3 +130,69 @@ func contains(k string, s []string) bool {
 	}
 	return false
 }
+
+// requestURI returns the URI as received by the server, or as it would be sent
+// for requests that didn't come from a server
+func requestURI(req *http.Request) string {
+	if req.RequestURI != "" {
+		return req.RequestURI
+	}
+	return req.URL.RequestURI()
+}
+
+// bodyAllowed tells whether a response to the given method with the given
+// status can have a body, as per section 3.3.3 of RFC 7230
+func bodyAllowed(method string, status int) bool {
+	switch {
+	case method == "HEAD":
+		return false
+	case isConnectSuccess(method, status):
+		return false
+	case status >= 100 && status < 200:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// lengthAllowed tells whether a response to the given method with the given
+// status can have a Content-Length. HEAD and 304 responses can, to describe
+// the body they would have had.
+func lengthAllowed(method string, status int) bool {
+	return status != http.StatusNoContent && !(status >= 100 && status < 200) && !isConnectSuccess(method, status)
+}
+
+// isConnectSuccess tells whether the response to a CONNECT established the
+// tunnel, after which what follows isn't a body (section 4.3.6 of RFC 7231)
+func isConnectSuccess(method string, status int) bool {
+	return method == "CONNECT" && status >= 200 && status < 300
+}
+
+func isChunked(te []string) bool {
+	for _, enc := range te {
+		if enc == "chunked" {
+			return true
+		}
+	}
+	return false
+}
+
+// announceTrailers declares the trailers we expect from the upstream so that
+// the client knows about them before the body starts
+func announceTrailers(dst, trailer http.Header) {
+	for k := range trailer {
+		dst.Add("Trailer", k)
+	}
+}
+
+// copyTrailers sets the trailers received from the upstream so that they get
+// sent to the client after the body. It uses http.TrailerPrefix so that
+// trailers that weren't announced are forwarded too.
+func copyTrailers(dst, trailer http.Header) {
+	for k, vv := range trailer {
+		for _, v := range vv {
+			dst.Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/filters"
+)
+
+func TestCopyHeadersMultipleValues(t *testing.T) {
+	src := http.Header{
+		"Set-Cookie":    {"a=1", "b=2", "c=3"},
+		"Cache-Control": {"no-cache", "no-store"},
+		"Keep-Alive":    {"timeout=5"},
+	}
+	dst := make(http.Header)
+	copyHeadersForForwarding(dst, src)
+	assert.Equal(t, []string{"a=1", "b=2", "c=3"}, dst["Set-Cookie"])
+	assert.Equal(t, []string{"no-cache", "no-store"}, dst["Cache-Control"])
+	assert.NotContains(t, dst, "Keep-Alive")
+}
+
+func TestCopyHeadersStripsPseudoHeaders(t *testing.T) {
+	src := http.Header{
+		":method":    {"GET"},
+		":path":      {"/"},
+		":authority": {"www.example.com"},
+		"Accept":     {"*/*"},
+	}
+	dst := make(http.Header)
+	copyHeadersForForwarding(dst, src)
+	assert.Equal(t, http.Header{"Accept": {"*/*"}}, dst)
+}
+
+func TestHTTP2DownstreamToHTTP1Upstream(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	proxy := httptest.NewUnstartedServer(filters.Join(New(&Options{
+		IdleTimeout: 30 * time.Second,
+		Upstreams:   []*url.URL{originURL},
+	})))
+	proxy.Config.Protocols = h2cProtocols()
+	proxy.Start()
+	defer proxy.Close()
+
+	transport := &http.Transport{Protocols: h2cProtocols()}
+	defer transport.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", proxy.URL+"/path", nil)
+	resp, err := transport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+
+	upstreamReq := <-received
+	assert.Equal(t, 1, upstreamReq.ProtoMajor)
+	assert.Equal(t, "/path", upstreamReq.URL.Path)
+	for k := range upstreamReq.Header {
+		assert.False(t, strings.HasPrefix(k, ":"), "pseudo-header %v reached the upstream", k)
+	}
+}
+
+func TestForwardMultipleSetCookies(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Set-Cookie", "a=1; Path=/")
+		w.Header().Add("Set-Cookie", "b=2; Path=/")
+		w.Header().Add("Set-Cookie", "c=3; Path=/")
+		w.Header()["X-Received-Cache-Control"] = req.Header["Cache-Control"]
+	}))
+	defer origin.Close()
+
+	client, closeProxy := proxiedClient(New(&Options{IdleTimeout: 30 * time.Second}))
+	defer closeProxy()
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Add("Cache-Control", "no-cache")
+	req.Header.Add("Cache-Control", "max-age=0")
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; Path=/", "c=3; Path=/"}, resp.Header["Set-Cookie"])
+	assert.Len(t, resp.Cookies(), 3)
+	assert.Equal(t, []string{"no-cache", "max-age=0"}, resp.Header["X-Received-Cache-Control"])
+}
@@ -28,6 +28,7 @@ var (
 	addr      = flag.String("addr", ":8080", "Address to listen")
 	maxConns  = flag.Uint64("maxconns", 0, "Max number of simultaneous connections allowed connections")
 	idleClose = flag.Uint64("idleclose", 30, "Time in seconds that an idle connection will be allowed before closing it")
+	proxyProt = flag.Bool("proxyprotocol", false, "Expect a PROXY protocol header on incoming connections, as sent by load balancers")
 )
 
 func main() {
@@ -56,6 +57,9 @@ func main() {
 
 	// Create server
 	srv := server.NewServer(filterChain)
+	// Read the PROXY header before the TLS handshake and the other wrappers,
+	// so that they see the client addresses
+	srv.ProxyProtocol = *proxyProt
 
 	// Add net.Listener wrappers for inbound connections
 	srv.AddListenerWrappers(
@@ -0,0 +1,40 @@
+package httpconnect
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// graceConn closes gracefully: it first shuts down its write side, so that the
+// peer gets everything that was sent followed by an EOF, and keeps reading
+// (and discarding) for up to grace before actually closing. Closing a socket
+// with unread data makes the OS reset the connection, which can throw away
+// the final bytes sent to the peer.
+type graceConn struct {
+	net.Conn
+	grace time.Duration
+}
+
+func withCloseGrace(conn net.Conn, grace time.Duration) net.Conn {
+	if grace <= 0 {
+		return conn
+	}
+	if _, ok := conn.(closeWriter); !ok {
+		return conn
+	}
+	return &graceConn{conn, grace}
+}
+
+func (c *graceConn) Close() error {
+	if err := c.Conn.(closeWriter).CloseWrite(); err == nil {
+		c.Conn.SetReadDeadline(time.Now().Add(c.grace))
+		io.Copy(ioutil.Discard, c.Conn)
+	}
+	return c.Conn.Close()
+}
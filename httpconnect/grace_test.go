@@ -0,0 +1,50 @@
+package httpconnect
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseGrace(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Keep sending while the other end goes away, so that it has unread
+		// data when closing
+		go conn.Write(make([]byte, 65536))
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn = withCloseGrace(conn, 500*time.Millisecond)
+	_, err = conn.Write([]byte("final frame"))
+	assert.NoError(t, err)
+	start := time.Now()
+	assert.NoError(t, conn.Close())
+	assert.True(t, time.Now().Sub(start) < time.Second, "shouldn't wait longer than the grace period")
+
+	select {
+	case b := <-received:
+		assert.Equal(t, "final frame", string(b), "buffered bytes should be delivered")
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "peer never got EOF")
+	}
+}
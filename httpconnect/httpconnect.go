@@ -24,6 +24,11 @@ type Options struct {
 	IdleTimeout  time.Duration
 	AllowedPorts []int
 	Dialer       func(network, address string) (net.Conn, error)
+
+	// TunnelCloseGrace is how long the upstream connection of a tunnel is
+	// given to flush and wind down once the tunnel is closed, instead of
+	// being torn down right away.
+	TunnelCloseGrace time.Duration
 }
 
 type httpConnectHandler struct {
@@ -54,7 +59,7 @@ func (f *httpConnectHandler) dial(initialReq *http.Request, addr string, port in
 		err = errors.New("Unable to dial %v: %v", addr, dialErr)
 		return
 	}
-	conn = idletiming.Conn(conn, f.IdleTimeout, nil)
+	conn = idletiming.Conn(withCloseGrace(conn, f.TunnelCloseGrace), f.IdleTimeout, nil)
 	return
 }
 
@@ -0,0 +1,206 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum length of a PROXY protocol v1 header, including the CRLF
+	maxProxyHeaderV1Length = 107
+	proxyHeaderTimeout     = 10 * time.Second
+)
+
+var proxyHeaderV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Wrapped proxyProtocolListener that generates the wrapped proxyProtocolConn
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+// NewProxyProtocolListener wraps a listener whose connections start with a
+// PROXY protocol (v1 or v2) header, as sent by load balancers, so that the
+// connections report the addresses declared in it. Connections without a
+// valid header are closed.
+func NewProxyProtocolListener(l net.Listener) net.Listener {
+	return &proxyProtocolListener{l}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	sac, _ := conn.(WrapConnEmbeddable)
+	return &proxyProtocolConn{
+		WrapConnEmbeddable: sac,
+		Conn:               conn,
+		reader:             bufio.NewReader(conn),
+	}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header lazily, on the first call
+// that needs it, so that slow clients don't hold up Accept.
+type proxyProtocolConn struct {
+	WrapConnEmbeddable
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	headerErr  error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtocolConn) OnState(s http.ConnState) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(s)
+	}
+}
+
+func (c *proxyProtocolConn) ControlMessage(msgType string, data interface{}) {
+	// Simply pass down the control message to the wrapped connection
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	}
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	sig, err := c.reader.Peek(len(proxyHeaderV2Signature))
+	if err == nil && bytes.Equal(sig, proxyHeaderV2Signature) {
+		c.remoteAddr, c.localAddr, err = readProxyHeaderV2(c.reader)
+	} else {
+		c.remoteAddr, c.localAddr, err = readProxyHeaderV1(c.reader)
+	}
+	if err != nil {
+		log.Debugf("Invalid PROXY protocol header from %v: %v", c.Conn.RemoteAddr(), err)
+		c.headerErr = err
+		c.Conn.Close()
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (src net.Addr, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < maxProxyHeaderV1Length {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, []byte("PROXY ")) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("not a PROXY protocol header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// Use the addresses of the connection itself
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol header %q", line)
+	}
+	src, err = parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err = parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(host string, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q in PROXY protocol header", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in PROXY protocol header", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (src net.Addr, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if header[12]&0x0F == 0 {
+		// LOCAL command, use the addresses of the connection itself
+		return nil, nil, nil
+	}
+
+	var ipLen int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// Unsupported family, use the addresses of the connection itself
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("truncated PROXY protocol header")
+	}
+	src = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
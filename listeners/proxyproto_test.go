@@ -0,0 +1,91 @@
+package listeners
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyProtocolListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.RemoteAddr))
+	})}
+	go server.Serve(NewProxyProtocolListener(NewDefaultListener(l)))
+	defer server.Close()
+
+	v2 := append([]byte(nil), proxyHeaderV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0x00, 12, 198, 51, 100, 9, 10, 0, 0, 1, 0x1F, 0x90, 0x00, 0x50)
+
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n", "203.0.113.7:5555"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 5555 80\r\n", "[2001:db8::1]:5555"},
+		{string(v2), "198.51.100.9:8080"},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		conn.Write([]byte(test.header + "GET / HTTP/1.1\r\nHost: site.com\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if assert.NoError(t, err) {
+			b, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, test.expected, string(b))
+		}
+		conn.Close()
+	}
+
+	// Connections without the header are rejected
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: site.com\r\n\r\n"))
+	_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.Error(t, err)
+}
+
+func TestProxyProtocolBeforeTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.RemoteAddr))
+	}))
+	// Load balancers send the header before the TLS handshake, so it has to
+	// be read from the raw connection
+	server.Listener = NewProxyProtocolListener(NewDefaultListener(server.Listener))
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 443\r\n"))
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", RootCAs: roots})
+	if !assert.NoError(t, tlsConn.Handshake(), "the ClientHello should follow the PROXY header") {
+		return
+	}
+	tlsConn.Write([]byte("GET / HTTP/1.1\r\nHost: site.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "203.0.113.7:5555", string(b))
+	}
+}
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"errors"
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/context"
 
@@ -15,6 +17,8 @@ import (
 var (
 	testingLocal = false
 	log          = golog.LoggerFor("server")
+
+	errConnNotAllowed = errors.New("Connection not allowed")
 )
 
 type listenerGenerator func(net.Listener) net.Listener
@@ -23,7 +27,12 @@ type listenerGenerator func(net.Listener) net.Listener
 type Server struct {
 	// Allow is a function that determines whether or not to allow connections
 	// from the given IP address. If unspecified, all connections are allowed.
-	Allow              func(string) bool
+	Allow func(string) bool
+	// ProxyProtocol makes the server expect a PROXY protocol header, as sent
+	// by load balancers, at the very start of inbound connections, before the
+	// TLS handshake if serving HTTPS. Allow and the listener wrappers see the
+	// client addresses declared in it.
+	ProxyProtocol      bool
 	httpServer         http.Server
 	listenerGenerators []listenerGenerator
 }
@@ -112,7 +121,13 @@ func (s *Server) Serve(listener net.Listener, readyCb func(addr string)) error {
 	return s.httpServer.Serve(l)
 }
 
+// wrapListenerIfNecessary wraps the raw TCP listener before anything else
+// touches its connections
 func (s *Server) wrapListenerIfNecessary(l net.Listener) net.Listener {
+	if s.ProxyProtocol {
+		log.Debug("Wrapping listener with PROXY protocol")
+		l = listeners.NewProxyProtocolListener(l)
+	}
 	if s.Allow != nil {
 		log.Debug("Wrapping listener with Allow")
 		return &allowinglistener{l, s.Allow}
@@ -130,15 +145,9 @@ func (l *allowinglistener) Accept() (net.Conn, error) {
 	if err != nil {
 		return conn, err
 	}
-
-	ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
-	if !l.allow(ip) {
-		conn.Close()
-		// Note - we don't return an error, because that causes http.Server to stop
-		// serving.
-	}
-
-	return conn, err
+	// The remote address may only be known after reading a PROXY protocol
+	// header, which shouldn't hold up accepting the next connections
+	return &allowingConn{Conn: conn, allow: l.allow}, nil
 }
 
 func (l *allowinglistener) Close() error {
@@ -148,3 +157,26 @@ func (l *allowinglistener) Close() error {
 func (l *allowinglistener) Addr() net.Addr {
 	return l.wrapped.Addr()
 }
+
+// allowingConn checks whether the connection is allowed on its first read,
+// from the goroutine serving it, and closes it if not
+type allowingConn struct {
+	net.Conn
+	once    sync.Once
+	allow   func(string) bool
+	allowed bool
+}
+
+func (c *allowingConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		ip := c.Conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		c.allowed = c.allow(ip)
+		if !c.allowed {
+			c.Conn.Close()
+		}
+	})
+	if !c.allowed {
+		return 0, errConnNotAllowed
+	}
+	return c.Conn.Read(b)
+}
@@ -443,6 +443,94 @@ func TestDisconnectingServer(t *testing.T) {
 	assert.Empty(t, string(out), "Server shouldn't have sent anything")
 }
 
+func TestProxyProtocolHTTPS(t *testing.T) {
+	allowed := make(chan string, 1)
+	s := basicServer(0, 30*time.Second)
+	s.ProxyProtocol = true
+	s.Allow = func(ip string) bool {
+		allowed <- ip
+		return true
+	}
+	ready := make(chan string)
+	go func() {
+		if err := s.ListenAndServeHTTPS("localhost:0", "key.pem", "cert.pem", func(addr string) { ready <- addr }); err != nil {
+			log.Errorf("Unable to serve: %v", err)
+		}
+	}()
+	addr := <-ready
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err, "should dial proxy server") {
+		return
+	}
+	defer conn.Close()
+	// Like a load balancer, send the header before the ClientHello
+	_, err = conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 443\r\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		CipherSuites:       preferredCipherSuites,
+		InsecureSkipVerify: true,
+	})
+	if !assert.NoError(t, tlsConn.Handshake(), "should handshake after the PROXY header") {
+		return
+	}
+	originURL, _ := url.Parse(httpOriginURL)
+	fmt.Fprintf(tlsConn, "GET /%s HTTP/1.1\r\nHost: %s\r\n\r\n", originURL.Path, originURL.Host)
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if assert.NoError(t, err) {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(buf), originResponse, "should read response")
+	}
+	assert.Equal(t, "203.0.113.7", <-allowed, "Allow should see the client address from the PROXY header")
+}
+
+func TestAllowAfterProxyHeader(t *testing.T) {
+	s := basicServer(0, 30*time.Second)
+	s.ProxyProtocol = true
+	s.Allow = func(ip string) bool {
+		return ip == "203.0.113.7"
+	}
+	ready := make(chan string)
+	go func() {
+		if err := s.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr }); err != nil {
+			log.Errorf("Unable to serve: %v", err)
+		}
+	}()
+	addr := <-ready
+
+	// A client that never sends its PROXY header shouldn't hold up the others
+	silent, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err, "should dial proxy server") {
+		return
+	}
+	defer silent.Close()
+
+	originURL, _ := url.Parse(httpOriginURL)
+	request := func(clientIP string) (*http.Response, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(conn, "PROXY TCP4 %s 10.0.0.1 5555 80\r\nGET %s HTTP/1.1\r\nHost: %s\r\n\r\n", clientIP, httpOriginURL, originURL.Host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+		}
+		return resp, err
+	}
+
+	resp, err := request("203.0.113.7")
+	if assert.NoError(t, err, "should be served while the silent client is pending") {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	_, err = request("198.51.100.1")
+	assert.Error(t, err, "should close connections that aren't allowed")
+}
+
 //
 // Auxiliary functions
 //
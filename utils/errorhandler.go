@@ -24,23 +24,33 @@ type StdHandler struct {
 
 func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
 	desc := err.Error()
-	cause := err
-	if structured, ok := err.(errors.Error); ok {
-		cause = structured.RootCause()
-	}
-	statusCode := http.StatusInternalServerError
+	cause := rootCause(err)
+	statusCode := StatusForError(err)
+	log.Errorf("Responding with %d due to %v: %v", statusCode, cause, desc)
+	w.WriteHeader(statusCode)
+	w.Write([]byte(http.StatusText(statusCode)))
+}
+
+// StatusForError maps an error to the status code to respond with: 504 for
+// timeouts, 502 for other network errors and 500 for everything else.
+func StatusForError(err error) int {
+	cause := rootCause(err)
 	if e, ok := cause.(net.Error); ok {
 		if e.Timeout() {
-			statusCode = http.StatusGatewayTimeout
-		} else {
-			statusCode = http.StatusBadGateway
+			return http.StatusGatewayTimeout
 		}
+		return http.StatusBadGateway
 	} else if cause == io.EOF {
-		statusCode = http.StatusBadGateway
+		return http.StatusBadGateway
 	}
-	log.Errorf("Responding with %d due to %v: %v", statusCode, cause, desc)
-	w.WriteHeader(statusCode)
-	w.Write([]byte(http.StatusText(statusCode)))
+	return http.StatusInternalServerError
+}
+
+func rootCause(err error) error {
+	if structured, ok := err.(errors.Error); ok {
+		return structured.RootCause()
+	}
+	return err
 }
 
 type ErrorHandlerFunc func(http.ResponseWriter, *http.Request, error)
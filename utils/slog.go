@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/golog"
+)
+
+// LevelTrace is the slog level golog trace messages are logged at
+const LevelTrace = slog.LevelDebug - 4
+
+// SlogLogger returns a golog output that writes to the given slog logger, for
+// use with golog.SetOutput. Messages keep the golog severity as their level,
+// and their context (e.g. the values of the current ops) as attributes, along
+// with the name of the logger.
+func SlogLogger(l *slog.Logger) golog.Output {
+	return &slogOutput{l}
+}
+
+type slogOutput struct {
+	l *slog.Logger
+}
+
+func (o *slogOutput) Debug(prefix string, skipFrames int, printStack bool, severity string, arg interface{}, values map[string]interface{}) {
+	o.log(prefix, severity, arg, values)
+}
+
+func (o *slogOutput) Error(prefix string, skipFrames int, printStack bool, severity string, arg interface{}, values map[string]interface{}) {
+	o.log(prefix, severity, arg, values)
+}
+
+func (o *slogOutput) log(prefix string, severity string, arg interface{}, values map[string]interface{}) {
+	level := slogLevel(severity)
+	ctx := context.Background()
+	if !o.l.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, len(values)+1)
+	// prefix is the name of the logger followed by ": "
+	attrs = append(attrs, slog.String("logger", strings.TrimSuffix(prefix, ": ")))
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		attrs = append(attrs, slog.Any(k, values[k]))
+	}
+	o.l.LogAttrs(ctx, level, fmt.Sprintf("%v", arg), attrs...)
+}
+
+func slogLevel(severity string) slog.Level {
+	switch severity {
+	case "TRACE":
+		return LevelTrace
+	case "DEBUG":
+		return slog.LevelDebug
+	case "FATAL":
+		return slog.LevelError + 4
+	default:
+		return slog.LevelError
+	}
+}